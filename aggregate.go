@@ -0,0 +1,454 @@
+package main
+
+// The aggregate and mapping subcommands sum per-cell results to countries,
+// either directly or through a precomputed cell-to-country mapping.
+
+import (
+    "fmt"
+	"flag"
+	"github.com/ctessum/geom"
+	"github.com/ctessum/geom/encoding/shp"
+	jshp "github.com/jonas-p/go-shp"
+
+	"mortality/aggregate"
+	"mortality/crs"
+	"mortality/ioformats"
+	"mortality/regrid"
+)
+
+// aggregateOptions holds the flags of the aggregate and mapping subcommands
+type aggregateOptions struct {
+	inputFile    string
+	outputFile   string
+	countryFile  string
+	fieldName    string
+	inmapGrid    string
+	mappingFile  string
+	damagesField string
+	area         string
+}
+
+// aggregateFlags defines the flags of the aggregate and mapping subcommands
+func aggregateFlags(name string) (*flag.FlagSet, *aggregateOptions) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	o := &aggregateOptions{}
+	fs.StringVar(&o.inputFile, "input", "", "Path to input shapefile with deaths data (required for aggregate and mapping apply)")
+	fs.StringVar(&o.outputFile, "output", "deaths_by_country.shp", "Path to output shapefile")
+	fs.StringVar(&o.countryFile, "countries", "ee_r250_correspondence.gpkg", "Path to country boundaries GeoPackage file")
+	fs.StringVar(&o.fieldName, "field", "TotalPopD", "Field name in input shapefile containing death values")
+	fs.StringVar(&o.inmapGrid, "inmap-grid", "", "Path to InMAP grid shapefile (required for mapping create)")
+	fs.StringVar(&o.mappingFile, "mapping", "inmap_country_mapping.csv", "Path to mapping file (create or read)")
+	fs.StringVar(&o.damagesField, "damages-field", "", "Field name in input shapefile containing monetary damages (optional, adds a Damages column)")
+	fs.StringVar(&o.area, "area", "planar", "How cells are measured to split them between countries for aggregate and mapping create: planar (in the grid's coordinates) or spherical (on the Earth, for longitude/latitude grids)")
+	fs.StringVar(errorSummary, "errorSummary", "", errorSummaryUsage)
+	return fs, o
+}
+
+// runAggregate runs the aggregate subcommand
+func runAggregate(args []string) error {
+    fs, o := aggregateFlags("aggregate")
+    if err := fs.Parse(args); err != nil {
+        return configError{err: err}
+    }
+    return directAggregation(fs, o)
+}
+
+// runMapping runs the mapping create and mapping apply subcommands
+func runMapping(args []string) error {
+    sub := ""
+    if len(args) > 0 {
+        sub, args = args[0], args[1:]
+    }
+    fs, o := aggregateFlags("mapping " + sub)
+    if sub != "create" && sub != "apply" {
+        usage()
+        return configErrorf("", "unknown mapping subcommand '%s'. Must be 'create' or 'apply'", sub)
+    }
+    if err := fs.Parse(args); err != nil {
+        return configError{err: err}
+    }
+    if sub == "create" {
+        return createMapping(fs, o)
+    }
+    return applyMapping(fs, o)
+}
+
+// projectToCountries reprojects cells read from cellFile to the coordinate
+// reference system of the countries, returning that CRS. Spherical areas can
+// only be used if it is longitude/latitude.
+func projectToCountries(cells []geom.Polygonal, cellFile, countryFile, area string) ([]geom.Polygonal, *crs.CRS, error) {
+	cellCRS, err := ioformats.ShapefileCRS(cellFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	countryCRS, err := ioformats.GeoPackageCRS(countryFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	if area == "spherical" && countryCRS != nil && !countryCRS.Geographic() {
+		return nil, nil, configErrorf("area", "-area spherical is for longitude/latitude countries, but %s is in %s", countryFile, countryCRS)
+	}
+	if cells, err = reproject(cells, cellCRS, countryCRS, cellFile); err != nil {
+		return nil, nil, err
+	}
+	return cells, countryCRS, nil
+}
+
+// createMapping computes the intersection matrix once and saves it
+func createMapping(fs *flag.FlagSet, o *aggregateOptions) error {
+    // Validate required flags
+    if o.inmapGrid == "" || o.countryFile == "" {
+        fmt.Println("Usage:")
+        fs.PrintDefaults()
+        return configErrorf("inmap-grid", "-inmap-grid and -countries flags are required for mapping create")
+    }
+    area, err := regrid.AreaMethod(o.area)
+    if err != nil {
+        return configErrorf("area", "%v", err)
+    }
+
+    fmt.Println("=== Creating Mapping ===")
+    fmt.Printf("InMAP grid: %s\n", o.inmapGrid)
+    fmt.Printf("Country file: %s\n", o.countryFile)
+    fmt.Printf("Output mapping: %s\n", o.mappingFile)
+    fmt.Printf("Area weighting: %s\n", o.area)
+    fmt.Println("\nReading geometries...")
+
+    // Read InMAP grid (just geometries, don't need IDs)
+    inmapCells, err := ioformats.ReadShapefileGeometries(o.inmapGrid)
+    if err != nil {
+        return err
+    }
+    fmt.Printf("Loaded %d InMAP cells\n", len(inmapCells))
+
+    // Read country geometries
+    countryShapes, err := ioformats.ReadGeoPackageGeometries(o.countryFile)
+    if err != nil {
+        return err
+    }
+    fmt.Printf("Loaded %d countries\n", len(countryShapes))
+    if inmapCells, _, err = projectToCountries(inmapCells, o.inmapGrid, o.countryFile, o.area); err != nil {
+        return err
+    }
+
+    fmt.Println("\nComputing intersection mapping (this may take a while)...")
+    mapping := aggregate.ComputeMapping(inmapCells, countryShapes, area)
+
+    fmt.Printf("Computed %d intersection records\n", len(mapping))
+    fmt.Printf("Saving mapping to %s...\n", o.mappingFile)
+    if err := aggregate.SaveMapping(mapping, o.mappingFile); err != nil {
+        return err
+    }
+
+    fmt.Println("Done! Mapping saved successfully.")
+    return nil
+}
+
+// applyMapping uses a precomputed mapping for fast aggregation
+func applyMapping(fs *flag.FlagSet, o *aggregateOptions) error {
+    // Validate required flags
+    if o.inputFile == "" {
+        fmt.Println("Usage:")
+        fs.PrintDefaults()
+        return configErrorf("input", "-input flag is required for mapping apply")
+    }
+
+    fmt.Println("=== Applying Mapping ===")
+    fmt.Printf("Input file: %s\n", o.inputFile)
+    fmt.Printf("Mapping file: %s\n", o.mappingFile)
+    fmt.Printf("Output file: %s\n", o.outputFile)
+    fmt.Printf("Field name: %s\n", o.fieldName)
+
+    fmt.Println("\nLoading mapping...")
+    mapping, err := aggregate.LoadMapping(o.mappingFile)
+    if err != nil {
+        return err
+    }
+    fmt.Printf("Loaded %d intersection records\n", len(mapping))
+
+    fmt.Println("Reading input data...")
+    _, inmapData, err := ioformats.ReadShapefile(o.inputFile, o.fieldName)
+    if err != nil {
+        return err
+    }
+    fmt.Printf("Loaded %d data cells\n", len(inmapData))
+
+    fmt.Println("Loading country geometries and names...")
+    countryShapes, countryNames, countryFIDs, err := ioformats.ReadGeoPackageFeatures(o.countryFile, countryNameColumn)
+    if err != nil {
+        return err
+    }
+    fmt.Printf("Loaded %d countries\n", len(countryShapes))
+
+    fmt.Println("Applying mapping...")
+    countryData := aggregate.Apply(mapping, inmapData, len(countryShapes))
+
+    var countryDamages []float64
+    if o.damagesField != "" {
+        fmt.Printf("Aggregating damages from field %s...\n", o.damagesField)
+        _, inmapDamages, err := ioformats.ReadShapefile(o.inputFile, o.damagesField)
+        if err != nil {
+            return err
+        }
+        countryDamages = aggregate.Apply(mapping, inmapDamages, len(countryShapes))
+    }
+
+    fmt.Println("Writing output...")
+    if err := writeTotDeathsWithNames(countryShapes, countryData, countryDamages, countryNames, countryFIDs, o.outputFile); err != nil {
+        return err
+    }
+    countryCRS, err := ioformats.GeoPackageCRS(o.countryFile)
+    if err != nil {
+        return err
+    }
+    if err := ioformats.WritePrj(o.outputFile, countryCRS); err != nil {
+        return err
+    }
+
+    fmt.Printf("\nDone! Output written to: %s\n", o.outputFile)
+    return nil
+}
+
+// directAggregation performs the full computation without mapping (original behavior)
+func directAggregation(fs *flag.FlagSet, o *aggregateOptions) error {
+    // Validate required flags
+    if o.inputFile == "" {
+        fmt.Println("Usage:")
+        fs.PrintDefaults()
+        return configErrorf("input", "-input flag is required")
+    }
+    area, err := regrid.AreaMethod(o.area)
+    if err != nil {
+        return configErrorf("area", "%v", err)
+    }
+
+    fmt.Printf("Input file: %s\n", o.inputFile)
+    fmt.Printf("Output file: %s\n", o.outputFile)
+    fmt.Printf("Country file: %s\n", o.countryFile)
+    fmt.Printf("Field name: %s\n", o.fieldName)
+    fmt.Printf("Area weighting: %s\n", o.area)
+    fmt.Println("\nStarting aggregation...")
+
+    inmapCells, attrib, err     := ioformats.ReadShapefile(o.inputFile, o.fieldName)
+    if err != nil {
+        return err
+    }
+    countryShapes, err          := ioformats.ReadGeoPackageGeometries(o.countryFile)
+    if err != nil {
+        return err
+    }
+    inmapCells, countryCRS, err := projectToCountries(inmapCells, o.inputFile, o.countryFile, o.area)
+    if err != nil {
+        return err
+    }
+    weights                     := regrid.ComputeWeights(inmapCells, countryShapes, area)
+    rattrib, err                := weights.Sum(attrib)
+    if err != nil {
+        return fmt.Errorf("regridding %s onto %s: %w", o.inputFile, o.countryFile, err)
+    }
+    var rdamages []float64
+    if o.damagesField != "" {
+        _, damages, err         := ioformats.ReadShapefile(o.inputFile, o.damagesField)
+        if err != nil {
+            return err
+        }
+        rdamages, err           = weights.Sum(damages)
+        if err != nil {
+            return fmt.Errorf("regridding %s onto %s: %w", o.inputFile, o.countryFile, err)
+        }
+    }
+    if err := writeCountryTotals(countryShapes, rattrib, rdamages, o.outputFile); err != nil {
+        return err
+    }
+    if err := ioformats.WritePrj(o.outputFile, countryCRS); err != nil {
+        return err
+    }
+
+    fmt.Printf("\nDone! Output written to: %s\n", o.outputFile)
+    return nil
+}
+
+
+//func readGBD() ([]float64) {
+
+//}
+
+//func assignToStates(df ???, stateVals []string, mapping ???) (gbdVals []string) {
+//}
+
+func writeShpData(cells []geom.Polygonal, native, regridded []float64) error {
+	type shpOut struct {
+		geom.Polygon
+		Native, Regridded, Diff float64
+	}
+
+	const filename = "regridded-states-to-InMAP-Cells.shp"
+	e, err := shp.NewEncoder(filename, shpOut{})
+	if err != nil {
+		return &ioformats.FileError{File: filename, Err: err}
+	}
+	defer e.Close()
+	for i, c := range cells {
+		err := e.Encode(shpOut{
+			Polygon:   c.Polygons()[0], // Need to change if ever using a multipolygon here.
+			Native:    native[i],
+			Regridded: regridded[i],
+			Diff:      regridded[i] - native[i],
+		})
+		if err != nil {
+			return &ioformats.FileError{File: filename, Row: i + 1, Err: err}
+		}
+	}
+	return nil
+}
+
+
+// writeCountryTotals writes aggregated deaths in the RRs field, and monetary
+// damages in a Damages field if damages is not nil
+func writeCountryTotals(cells []geom.Polygonal, native, damages []float64, filename string) error {
+	if damages == nil {
+		type shpOut struct {
+			geom.Polygon
+			RRs float64
+		}
+		e, err := shp.NewEncoder(filename, shpOut{})
+		if err != nil {
+			return &ioformats.FileError{File: filename, Err: err}
+		}
+		defer e.Close()
+		for i, c := range cells {
+			err := e.Encode(shpOut{
+				Polygon:   c.Polygons()[0], // Need to change if ever using a multipolygon here.
+				RRs:       native[i],
+			})
+			if err != nil {
+				return &ioformats.FileError{File: filename, Row: i + 1, Err: err}
+			}
+		}
+		return nil
+	}
+
+	type shpOut struct {
+		geom.Polygon
+		RRs     float64
+		Damages float64
+	}
+	e, err := shp.NewEncoder(filename, shpOut{})
+	if err != nil {
+		return &ioformats.FileError{File: filename, Err: err}
+	}
+	defer e.Close()
+	for i, c := range cells {
+		err := e.Encode(shpOut{
+			Polygon:   c.Polygons()[0], // Need to change if ever using a multipolygon here.
+			RRs:       native[i],
+			Damages:   damages[i],
+		})
+		if err != nil {
+			return &ioformats.FileError{File: filename, Row: i + 1, Err: err}
+		}
+	}
+	return nil
+}
+
+// writeTotDeathsWithNames writes output shapefile with country names and fids using jonas-p/go-shp.
+// A Damages column is added if damages is not nil.
+func writeTotDeathsWithNames(cells []geom.Polygonal, native, damages []float64, names []string, fids []int, filename string) error {
+	// Create shapefile
+	shape, err := jshp.Create(filename, jshp.POLYGON)
+	if err != nil {
+		return &ioformats.FileError{File: filename, Err: err}
+	}
+	defer shape.Close()
+
+	// Add attribute fields
+	fields := []jshp.Field{
+		jshp.NumberField("FID", 9),
+		jshp.StringField("Country", 80),
+		jshp.FloatField("Deaths", 19, 11),
+	}
+	if damages != nil {
+		// Damages need more integer digits than deaths
+		fields = append(fields, jshp.FloatField("Damages", 24, 4))
+	}
+	if err := shape.SetFields(fields); err != nil {
+		return &ioformats.FileError{File: filename, Err: err}
+	}
+
+	for i, c := range cells {
+		countryName := ""
+		countryFID := 0
+		if i < len(names) {
+			countryName = names[i]
+		}
+		if i < len(fids) {
+			countryFID = fids[i]
+		}
+
+		// Write the shape and attributes
+		shape.Write(ioformats.ShpPolygon(c))
+		values := []interface{}{countryFID, countryName, native[i]}
+		if damages != nil {
+			values = append(values, damages[i])
+		}
+		for j, v := range values {
+			if err := shape.WriteAttribute(i, j, v); err != nil {
+				return &ioformats.FileError{File: filename, Row: i + 1, Field: fields[j].String(), Err: err}
+			}
+		}
+	}
+	return nil
+}
+
+func writeOutCountries(cells []geom.Polygonal, native []float64, filename string, countryName []float64) error {
+	type shpOut struct {
+		geom.Polygon
+		Deaths float64
+        Country float64
+	}
+
+	e, err := shp.NewEncoder(filename, shpOut{})
+	if err != nil {
+		return &ioformats.FileError{File: filename, Err: err}
+	}
+	defer e.Close()
+	for i, c := range cells {
+		err := e.Encode(shpOut{
+			Polygon:   c.Polygons()[0], // Need to change if ever using a multipolygon here.
+			Deaths:    native[i],
+            Country:   countryName[i],
+		})
+		if err != nil {
+			return &ioformats.FileError{File: filename, Row: i + 1, Err: err}
+		}
+	}
+	return nil
+}
+
+
+
+// Getting the state data (strings).
+func getStateData(shpFile, pol string) ([]geom.Polygonal, []string, error) {
+	s, err := shp.NewDecoder(shpFile)
+	if err != nil {
+		return nil, nil, &ioformats.FileError{File: shpFile, Err: err}
+	}
+
+	var data []string
+	var cells []geom.Polygonal
+	for {
+		g, fields, more := s.DecodeRowFields(pol)
+		if !more {
+			break
+		}
+		v := fields[pol]
+		cells = append(cells, g.(geom.Polygonal))
+		data = append(data, v)
+
+	}
+	s.Close()
+	if err := s.Error(); err != nil {
+		return nil, nil, &ioformats.FileError{File: shpFile, Err: err}
+	}
+	return cells, data, nil
+}
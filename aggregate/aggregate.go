@@ -0,0 +1,193 @@
+// Package aggregate sums per-cell results to countries or other regions
+// through a sparse mapping of the fraction of each cell in each region.
+package aggregate
+
+import (
+	"encoding/csv"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/ctessum/geom"
+	"github.com/ctessum/geom/index/rtree"
+
+	"mortality/ioformats"
+	"mortality/regrid"
+)
+
+// MappingRecord represents one entry in the sparse intersection matrix
+// between a grid and a set of regions
+type MappingRecord struct {
+	InmapCellIndex int     // Index of InMAP cell
+	CountryIndex   int     // Index of country
+	Fraction       float64 // What fraction of InMAP cell data goes to this country
+}
+
+// ComputeMapping creates the sparse intersection matrix between cells and
+// countries, processing countries in parallel. Each record gives the
+// fraction of the area of a cell that lies in a country, measured with area
+// (regrid.Planar if nil).
+func ComputeMapping(cells, countries []geom.Polygonal, area regrid.AreaFunc) []MappingRecord {
+	if area == nil {
+		area = regrid.Planar
+	}
+	type data struct {
+		geom.Polygonal
+		index int
+		area  float64
+	}
+
+	index := rtree.NewTree(25, 50)
+	for i, g := range cells {
+		index.Insert(&data{
+			Polygonal: g,
+			index:     i,
+			area:      area(g),
+		})
+	}
+
+	type countryRecords struct {
+		countryIdx int
+		records    []MappingRecord
+	}
+	resultsChan := make(chan countryRecords, len(countries))
+	var wg sync.WaitGroup
+
+	// Semaphore to limit concurrent goroutines (avoid overwhelming the system)
+	maxConcurrent := 8
+	sem := make(chan struct{}, maxConcurrent)
+
+	for countryIdx, countryGeom := range countries {
+		wg.Add(1)
+		sem <- struct{}{} // Acquire semaphore
+
+		go func(idx int, g geom.Polygonal) {
+			defer wg.Done()
+			defer func() { <-sem }() // Release semaphore
+
+			var localRecords []MappingRecord
+			for _, dI := range index.SearchIntersect(g.Bounds()) {
+				d := dI.(*data)
+				isect := g.Intersection(d.Polygonal)
+				if isect == nil {
+					continue
+				}
+				fraction := area(isect) / d.area
+				if fraction > 0 {
+					localRecords = append(localRecords, MappingRecord{
+						InmapCellIndex: d.index,
+						CountryIndex:   idx,
+						Fraction:       fraction,
+					})
+				}
+			}
+			resultsChan <- countryRecords{countryIdx: idx, records: localRecords}
+		}(countryIdx, countryGeom)
+	}
+
+	// Close results channel when all goroutines complete
+	go func() {
+		wg.Wait()
+		close(resultsChan)
+	}()
+
+	var allRecords []MappingRecord
+	for result := range resultsChan {
+		allRecords = append(allRecords, result.records...)
+	}
+	return allRecords
+}
+
+// SaveMapping writes the mapping to a CSV file with columns
+// inmap_cell_index, country_index and fraction
+func SaveMapping(records []MappingRecord, filename string) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := file.WriteString("inmap_cell_index,country_index,fraction\n"); err != nil {
+		return err
+	}
+	for _, r := range records {
+		if _, err := fmt.Fprintf(file, "%d,%d,%.15f\n", r.InmapCellIndex, r.CountryIndex, r.Fraction); err != nil {
+			return err
+		}
+	}
+	return file.Close()
+}
+
+// LoadMapping reads a mapping written by SaveMapping
+func LoadMapping(filename string) ([]MappingRecord, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	lines, err := r.ReadAll()
+	if err != nil {
+		return nil, &ioformats.FileError{File: filename, Err: err}
+	}
+
+	var records []MappingRecord
+	for i, parts := range lines {
+		if i == 0 || len(parts) != 3 {
+			continue // Skip header and malformed lines
+		}
+		inmapIdx, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+		if err != nil {
+			return nil, &ioformats.FileError{File: filename, Row: i + 1, Field: "inmap_cell_index", Err: err}
+		}
+		countryIdx, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, &ioformats.FileError{File: filename, Row: i + 1, Field: "country_index", Err: err}
+		}
+		fraction, err := strconv.ParseFloat(strings.TrimSpace(parts[2]), 64)
+		if err != nil {
+			return nil, &ioformats.FileError{File: filename, Row: i + 1, Field: "fraction", Err: err}
+		}
+		records = append(records, MappingRecord{
+			InmapCellIndex: inmapIdx,
+			CountryIndex:   countryIdx,
+			Fraction:       fraction,
+		})
+	}
+	return records, nil
+}
+
+// Check returns an error if the mapping refers to cells or countries beyond
+// nCells and nCountries
+func Check(mapping []MappingRecord, nCells, nCountries int) error {
+	for _, r := range mapping {
+		if r.InmapCellIndex >= nCells || r.CountryIndex >= nCountries {
+			return fmt.Errorf("mapping refers to cell %d and country %d, but there are %d cells and %d countries",
+				r.InmapCellIndex, r.CountryIndex, nCells, nCountries)
+		}
+	}
+	return nil
+}
+
+// Apply sums cell data to countries using the mapping. The result has one
+// element per country up to the largest country index in the mapping, or
+// nCountries if that is larger. Records for cells beyond the data, and cells
+// with missing (NaN) values, are ignored.
+func Apply(mapping []MappingRecord, cellData []float64, nCountries int) []float64 {
+	for _, r := range mapping {
+		if r.CountryIndex+1 > nCountries {
+			nCountries = r.CountryIndex + 1
+		}
+	}
+	countryData := make([]float64, nCountries)
+	for _, r := range mapping {
+		if r.InmapCellIndex < len(cellData) && !math.IsNaN(cellData[r.InmapCellIndex]) {
+			countryData[r.CountryIndex] += cellData[r.InmapCellIndex] * r.Fraction
+		}
+	}
+	return countryData
+}
@@ -0,0 +1,176 @@
+package main
+
+// The areas subcommand shows how much regridding with planar areas moves a
+// total compared with areas on the sphere, before choosing areaWeighting or
+// the -area flag of aggregate and mapping create.
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/ctessum/geom"
+
+	"mortality/ioformats"
+	"mortality/regrid"
+)
+
+// areaRegion is a row of the areas comparison: a country, or a latitude band
+// of the cells of a grid
+type areaRegion struct {
+	name              string
+	planar, spherical float64
+}
+
+// runAreas runs the areas subcommand. It sums a field of a shapefile of
+// longitude/latitude cells onto countries or another grid twice, once with
+// planar and once with spherical area weights, and writes the totals of
+// each country, or of each latitude band of the grid, to a CSV file.
+func runAreas(args []string) error {
+	fs := flag.NewFlagSet("areas", flag.ContinueOnError)
+	inputFile := fs.String("input", "", "Path to input shapefile of longitude/latitude cells (required)")
+	fieldName := fs.String("field", "TotalPop", "Field name in input shapefile containing the totals to compare (e.g. population or deaths)")
+	countryFile := fs.String("countries", "", "Path to country boundaries GeoPackage file to sum onto")
+	gridFile := fs.String("grid", "", "Path to grid shapefile to sum onto instead of countries, e.g. the InMAP grid")
+	band := fs.Float64("band", 10, "Width in degrees of the latitude bands the -grid totals are reported by")
+	outputFile := fs.String("output", "area_weighting.csv", "Path to output CSV file")
+	fs.StringVar(errorSummary, "errorSummary", "", errorSummaryUsage)
+	if err := fs.Parse(args); err != nil {
+		return configError{err: err}
+	}
+	if *inputFile == "" {
+		fmt.Println("Usage:")
+		fs.PrintDefaults()
+		return configErrorf("input", "-input flag is required")
+	}
+	if (*countryFile == "") == (*gridFile == "") {
+		return configErrorf("countries", "give one of -countries and -grid")
+	}
+	if *band <= 0 {
+		return configErrorf("band", "-band must be positive")
+	}
+
+	cells, values, err := ioformats.ReadShapefile(*inputFile, *fieldName)
+	if err != nil {
+		return err
+	}
+	var targets []geom.Polygonal
+	var names []string
+	targetFile := *gridFile
+	if *countryFile != "" {
+		targetFile = *countryFile
+		if targets, names, _, err = ioformats.ReadGeoPackageFeatures(*countryFile, countryNameColumn); err != nil {
+			return err
+		}
+	} else if targets, err = ioformats.ReadShapefileGeometries(*gridFile); err != nil {
+		return err
+	}
+	inputCRS, err := ioformats.ShapefileCRS(*inputFile)
+	if err != nil {
+		return err
+	}
+	targetCRS, err := ioformats.ReadCRS(targetFile)
+	if err != nil {
+		return err
+	}
+	if targetCRS != nil && !targetCRS.Geographic() {
+		return configErrorf("", "%s is in %s, which is regridded with its planar areas; the comparison is for longitude/latitude", targetFile, targetCRS)
+	}
+	if cells, err = reproject(cells, inputCRS, targetCRS, *inputFile); err != nil {
+		return err
+	}
+	fmt.Printf("Summing %s of %d cells onto %d regions with planar and spherical areas\n", *fieldName, len(cells), len(targets))
+
+	planar, err := regrid.ComputeWeights(cells, targets, regrid.Planar).Sum(values)
+	if err != nil {
+		return err
+	}
+	spherical, err := regrid.ComputeWeights(cells, targets, regrid.Spherical).Sum(values)
+	if err != nil {
+		return err
+	}
+
+	var regions []*areaRegion
+	if names != nil {
+		for i, name := range names {
+			regions = append(regions, &areaRegion{name: name, planar: planar[i], spherical: spherical[i]})
+		}
+	} else {
+		bands := make(map[float64]*areaRegion)
+		for i, t := range targets {
+			b := t.Bounds()
+			lat := *band * math.Floor((b.Min.Y+b.Max.Y)/2 / *band)
+			r, ok := bands[lat]
+			if !ok {
+				r = &areaRegion{name: fmt.Sprintf("%g to %g", lat, lat+*band)}
+				bands[lat] = r
+			}
+			r.planar += planar[i]
+			r.spherical += spherical[i]
+		}
+		var lats []float64
+		for lat := range bands {
+			lats = append(lats, lat)
+		}
+		sort.Float64s(lats)
+		for _, lat := range lats {
+			regions = append(regions, bands[lat])
+		}
+	}
+	return writeAreaComparison(*outputFile, values, regions)
+}
+
+// writeAreaComparison writes the planar and spherical totals of each region
+// and prints the overall totals and the largest differences
+func writeAreaComparison(filename string, values []float64, regions []*areaRegion) error {
+	var input, planar, spherical, moved float64
+	for _, v := range values {
+		if !math.IsNaN(v) {
+			input += v
+		}
+	}
+	rows := [][]string{{"region", "planar", "spherical", "difference", "relative_difference"}}
+	for _, r := range regions {
+		planar += r.planar
+		spherical += r.spherical
+		moved += math.Abs(r.spherical - r.planar)
+		rows = append(rows, []string{r.name,
+			strconv.FormatFloat(r.planar, 'g', -1, 64),
+			strconv.FormatFloat(r.spherical, 'g', -1, 64),
+			strconv.FormatFloat(r.spherical-r.planar, 'g', -1, 64),
+			strconv.FormatFloat(relativeDifference(r.planar, r.spherical), 'g', 6, 64)})
+	}
+	if err := writeCSV(filename, rows); err != nil {
+		return err
+	}
+
+	fmt.Printf("Input total:     %g\n", input)
+	fmt.Printf("Planar total:    %g\n", planar)
+	fmt.Printf("Spherical total: %g (%+.3g%%)\n", spherical, 100*relativeDifference(planar, spherical))
+	if spherical != 0 {
+		fmt.Printf("Share of the total moved between regions: %.3g%%\n", 100*moved/2/math.Abs(spherical))
+	}
+	largest := append([]*areaRegion(nil), regions...)
+	sort.SliceStable(largest, func(i, j int) bool {
+		return math.Abs(largest[i].spherical-largest[i].planar) > math.Abs(largest[j].spherical-largest[j].planar)
+	})
+	if len(largest) > 10 {
+		largest = largest[:10]
+	}
+	fmt.Println("Largest differences (spherical - planar):")
+	for _, r := range largest {
+		fmt.Printf("  %-30s %12.6g %+8.3g%%\n", r.name, r.spherical-r.planar, 100*relativeDifference(r.planar, r.spherical))
+	}
+	fmt.Printf("Comparison written to %s\n", filename)
+	return nil
+}
+
+// relativeDifference returns (b-a)/a, or 0 if both are 0
+func relativeDifference(a, b float64) float64 {
+	if a == b {
+		return 0
+	}
+	return (b - a) / a
+}
@@ -0,0 +1,183 @@
+// Package attribution calculates the deaths attributable to a PM2.5 source
+// from gridded concentrations, population and baseline mortality.
+//
+// In every function, for each cell, population is the total population,
+// countryRegrid the fraction of it in the age group, allcausemort the
+// baseline mortality rate of the cause per 100,000, and ijhat the adjustment
+// factor relating the baseline rate to the rate at zero exposure. totpm is
+// the total PM2.5 concentration and resultpm the concentration from the
+// source (or, for the scenario method, the policy concentration). Cells
+// where totpm or resultpm is missing (NaN), whichever file it was read from,
+// have NaN attributable deaths. Missing baseline inputs (ijhat, countryRegrid
+// or allcausemort) count as no deaths instead.
+package attribution
+
+import (
+	"fmt"
+	"math"
+
+	"mortality/crf"
+)
+
+// Methods lists the supported attribution methods
+var Methods = []string{"proportional", "zeroout", "scenario"}
+
+// Attribute calculates the deaths attributable to resultpm in each cell:
+//   - proportional: deaths(totpm) are attributed in proportion to resultpm/totpm;
+//   - zeroout: deaths(totpm + resultpm) - deaths(totpm);
+//   - scenario: deaths(totpm) - deaths(resultpm), i.e. deaths avoided by
+//     moving from the baseline totpm to the policy resultpm.
+func Attribute(method string, totpm, resultpm, population, ijhat, countryRegrid, allcausemort []float64, params crf.Function) ([]float64, error) {
+	var attrib []float64
+	switch method {
+	case "zeroout":
+		totdeaths := TotDeathsSum(totpm, resultpm, population, ijhat, countryRegrid, allcausemort, params)
+		baseline := BaseDeaths(totpm, population, ijhat, countryRegrid, allcausemort, params)
+		attrib = ZeroOut(totdeaths, baseline)
+	case "scenario":
+		baseline := BaseDeaths(totpm, population, ijhat, countryRegrid, allcausemort, params)
+		policy := BaseDeaths(resultpm, population, ijhat, countryRegrid, allcausemort, params)
+		attrib = DeathsAvoided(baseline, policy)
+	case "proportional", "":
+		totdeaths := TotDeaths(totpm, resultpm, population, ijhat, countryRegrid, allcausemort, params)
+		attrib = Proportional(totpm, totdeaths, resultpm)
+	default:
+		return nil, fmt.Errorf("unknown attribution method %q", method)
+	}
+	for t := range attrib {
+		if Missing(totpm[t], resultpm[t]) {
+			attrib[t] = math.NaN()
+		}
+	}
+	return attrib, nil
+}
+
+// Missing reports whether either concentration of a cell is missing, in
+// which case its attributable deaths are NaN
+func Missing(totpm, resultpm float64) bool {
+	return math.IsNaN(totpm) || math.IsNaN(resultpm)
+}
+
+// Cell calculates deaths attributable to resultpm in one cell using the
+// given attribution method. It gives the same result as Attribute for that cell.
+func Cell(method string, totpm, resultpm, population, ijhat, countryRegrid, allcausemort float64, params crf.Function) float64 {
+	if Missing(totpm, resultpm) {
+		return math.NaN()
+	}
+	if method == "scenario" {
+		baseline := CellDeathsSafe(totpm, population, ijhat, countryRegrid, allcausemort, params)
+		policy := CellDeathsSafe(resultpm, population, ijhat, countryRegrid, allcausemort, params)
+		return baseline - policy
+	}
+	if method == "zeroout" {
+		totdeaths := CellDeathsSafe(totpm+resultpm, population, ijhat, countryRegrid, allcausemort, params)
+		baseline := CellDeathsSafe(totpm, population, ijhat, countryRegrid, allcausemort, params)
+		return ZeroOutCell(totdeaths, baseline)
+	}
+	totdeaths := CellDeaths(totpm, population, ijhat, countryRegrid, allcausemort, params)
+	return ProportionalCell(totpm, totdeaths, resultpm)
+}
+
+// TotDeathsSum calculates total deaths with sum of concentrations (totpm + resultpm)
+// for zero-out methodology
+func TotDeathsSum(totpm, resultpm, population, ijhat, countryRegrid, allcausemort []float64, params crf.Function) (deaths []float64) {
+	for t := range totpm {
+		dd := CellDeathsSafe(totpm[t]+resultpm[t], population[t], ijhat[t], countryRegrid[t], allcausemort[t], params)
+		deaths = append(deaths, dd)
+	}
+	return deaths
+}
+
+// BaseDeaths calculates baseline deaths using only totpm (no resultpm)
+// Used for zero-out methodology to establish baseline scenario
+func BaseDeaths(totpm, population, ijhat, countryRegrid, allcausemort []float64, params crf.Function) (deaths []float64) {
+	for t := range totpm {
+		dd := CellDeathsSafe(totpm[t], population[t], ijhat[t], countryRegrid[t], allcausemort[t], params)
+		deaths = append(deaths, dd)
+	}
+	return deaths
+}
+
+// TotDeaths calculates deaths at totpm, for proportional attribution
+func TotDeaths(totpm, resultpm, population, ijhat, countryRegrid, allcausemort []float64, params crf.Function) (deaths []float64) {
+	for t := range totpm {
+		dd := CellDeaths(totpm[t], population[t], ijhat[t], countryRegrid[t], allcausemort[t], params)
+		deaths = append(deaths, dd)
+	}
+	return deaths
+}
+
+// CellDeaths calculates deaths in one cell at concentration concs
+func CellDeaths(concs, population, ijhat, countryRegrid, allcausemort float64, params crf.Function) float64 {
+	return (params.RR(concs) - 1) * (population / ijhat) * countryRegrid * allcausemort / 100000
+}
+
+// CellDeathsSafe is CellDeaths with the missing-data handling of the zero-out
+// method: missing baseline inputs give no deaths
+func CellDeathsSafe(concs, population, ijhat, countryRegrid, allcausemort float64, params crf.Function) float64 {
+	if ijhat == 0 || math.IsNaN(ijhat) || math.IsNaN(allcausemort) || math.IsNaN(countryRegrid) {
+		return 0.0
+	}
+	dd := CellDeaths(concs, population, ijhat, countryRegrid, allcausemort, params)
+	if math.IsNaN(dd) || math.IsInf(dd, 0) {
+		return 0.0
+	}
+	return dd
+}
+
+// ZeroOut calculates attribution using absolute difference methodology
+// Formula: deaths = totalDeaths - baselineDeaths
+// Represents deaths that would be avoided if source were removed entirely
+func ZeroOut(totdeaths, baseline []float64) []float64 {
+	var attrib []float64
+	for t := range totdeaths {
+		attrib = append(attrib, ZeroOutCell(totdeaths[t], baseline[t]))
+	}
+	return attrib
+}
+
+// ZeroOutCell applies the zero-out formula to one cell
+func ZeroOutCell(totdeaths, baseline float64) float64 {
+	if totdeaths == 0.0 {
+		return 0.0
+	}
+	dd := totdeaths - baseline
+	if math.IsNaN(dd) {
+		return 0.0
+	}
+	return dd
+}
+
+// DeathsAvoided calculates the scenario difference
+// Formula: deaths = baselineDeaths - policyDeaths
+// Negative values are deaths added by the policy
+func DeathsAvoided(baseline, policy []float64) []float64 {
+	var attrib []float64
+	for t := range baseline {
+		attrib = append(attrib, baseline[t]-policy[t])
+	}
+	return attrib
+}
+
+// Proportional calculates proportional attribution
+// Formula: deaths = resultpm * totdeaths / totpm
+// Represents proportional contribution of source to total deaths
+func Proportional(totpm, totdeaths, resultpm []float64) []float64 {
+	var attrib []float64
+	for t := range totpm {
+		attrib = append(attrib, ProportionalCell(totpm[t], totdeaths[t], resultpm[t]))
+	}
+	return attrib
+}
+
+// ProportionalCell applies the proportional formula to one cell
+func ProportionalCell(totpm, totdeaths, resultpm float64) float64 {
+	if totpm == 0.0 {
+		return 0.0
+	}
+	dd := resultpm * totdeaths / totpm
+	if math.IsNaN(dd) {
+		return 0.0
+	}
+	return dd
+}
@@ -0,0 +1,105 @@
+package attribution
+
+import "math"
+
+// The functions below apportion the deaths in one cell among several
+// sources whose concentrations srcs are part of totpm. Each returns one
+// share per source followed by the share of everything else. Cells with a
+// missing (NaN) concentration have no shares; callers give them NaN.
+
+// ProportionalShares splits totdeaths among the sources by their share of
+// totpm; the last element is the share of the remaining concentration
+func ProportionalShares(totpm, totdeaths float64, srcs []float64) []float64 {
+	var sum float64
+	for _, v := range srcs {
+		sum += v
+	}
+	scale := 1.0
+	if sum > totpm && sum > 0 {
+		scale = totpm / sum
+	}
+	shares := make([]float64, len(srcs)+1)
+	for s, v := range srcs {
+		shares[s] = ProportionalCell(totpm, totdeaths, v*scale)
+	}
+	shares[len(srcs)] = ProportionalCell(totpm, totdeaths, totpm-sum*scale)
+	return shares
+}
+
+// ZeroOutShares gives each source the deaths avoided by removing it alone from
+// totpm plus all the sources, as Cell does for a single source; the last
+// element is the remainder of deaths(totpm + sources)
+func ZeroOutShares(totpm float64, srcs []float64, deaths func(float64) float64) []float64 {
+	total := totpm
+	for _, v := range srcs {
+		total += v
+	}
+	shares := make([]float64, len(srcs)+1)
+	all := deaths(total)
+	rest := all
+	for s, v := range srcs {
+		shares[s] = ZeroOutCell(all, deaths(math.Max(total-v, 0)))
+		rest -= shares[s]
+	}
+	shares[len(srcs)] = rest
+	return shares
+}
+
+// ShapleyShares splits the deaths above the background concentration totpm
+// among the sources added to it by their Shapley values, i.e. each source's
+// marginal effect averaged over every order in which sources could be added
+// to the background. The last element is the background deaths, so the
+// shares add up to deaths(totpm + sources). weights are
+// ShapleyWeights(len(srcs)).
+func ShapleyShares(totpm float64, srcs []float64, weights []float64, deaths func(float64) float64) []float64 {
+	n := len(srcs)
+
+	// Deaths for every subset of sources added to the background
+	subsets := 1 << uint(n)
+	d := make([]float64, subsets)
+	for mask := 0; mask < subsets; mask++ {
+		concs := totpm
+		for s := 0; s < n; s++ {
+			if mask&(1<<uint(s)) != 0 {
+				concs += srcs[s]
+			}
+		}
+		d[mask] = deaths(concs)
+	}
+
+	shares := make([]float64, n+1)
+	for s := 0; s < n; s++ {
+		bit := 1 << uint(s)
+		for mask := 0; mask < subsets; mask++ {
+			if mask&bit != 0 {
+				continue
+			}
+			shares[s] += weights[bitCount(mask)] * (d[mask|bit] - d[mask])
+		}
+	}
+	shares[n] = d[0]
+	return shares
+}
+
+// ShapleyWeights returns |S|!(n-|S|-1)!/n! for each coalition size |S| < n
+func ShapleyWeights(n int) []float64 {
+	w := make([]float64, n)
+	for k := 0; k < n; k++ {
+		w[k] = math.Exp(lgammaInt(k+1) + lgammaInt(n-k) - lgammaInt(n+1))
+	}
+	return w
+}
+
+// lgammaInt returns log((x-1)!)
+func lgammaInt(x int) float64 {
+	v, _ := math.Lgamma(float64(x))
+	return v
+}
+
+func bitCount(x int) int {
+	n := 0
+	for ; x != 0; x &= x - 1 {
+		n++
+	}
+	return n
+}
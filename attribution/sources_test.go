@@ -0,0 +1,76 @@
+package attribution
+
+import (
+	"math"
+	"testing"
+)
+
+func TestShapleySharesEfficiency(t *testing.T) {
+	// A non-linear concentration-response, so that the sources interact
+	deaths := func(c float64) float64 { return 100 * (1 - math.Exp(-0.05*c)) }
+	for _, tc := range []struct {
+		totpm float64
+		srcs  []float64
+	}{
+		{10, []float64{5}},
+		{10, []float64{5, 2}},
+		{0, []float64{3, 8, 1}},
+		{25, []float64{1, 2, 3, 4, 5}},
+		{4, []float64{0, 6, 0.5}},
+	} {
+		shares := ShapleyShares(tc.totpm, tc.srcs, ShapleyWeights(len(tc.srcs)), deaths)
+		total := tc.totpm
+		for _, v := range tc.srcs {
+			total += v
+		}
+		var sum float64
+		for _, s := range shares {
+			sum += s
+		}
+		if want := deaths(total); math.Abs(sum-want) > 1e-9 {
+			t.Errorf("totpm=%g srcs=%v: shares sum to %g, want deaths(%g) = %g", tc.totpm, tc.srcs, sum, total, want)
+		}
+		if bg := shares[len(tc.srcs)]; math.Abs(bg-deaths(tc.totpm)) > 1e-9 {
+			t.Errorf("totpm=%g srcs=%v: background share %g, want %g", tc.totpm, tc.srcs, bg, deaths(tc.totpm))
+		}
+	}
+}
+
+func TestShapleySharesSymmetry(t *testing.T) {
+	deaths := func(c float64) float64 { return math.Log(1 + c) }
+	shares := ShapleyShares(5, []float64{3, 3, 1}, ShapleyWeights(3), deaths)
+	if math.Abs(shares[0]-shares[1]) > 1e-12 {
+		t.Errorf("equal sources get %g and %g", shares[0], shares[1])
+	}
+	if shares[2] >= shares[0] {
+		t.Errorf("smaller source gets %g, not less than %g", shares[2], shares[0])
+	}
+}
+
+func TestZeroOutSharesSingleSource(t *testing.T) {
+	// One source gives the single-source zero-out result
+	deaths := func(c float64) float64 { return 100 * (1 - math.Exp(-0.05*c)) }
+	shares := ZeroOutShares(10, []float64{5}, deaths)
+	if want := deaths(15) - deaths(10); math.Abs(shares[0]-want) > 1e-12 {
+		t.Errorf("source share %g, want %g", shares[0], want)
+	}
+	if math.Abs(shares[0]+shares[1]-deaths(15)) > 1e-12 {
+		t.Errorf("shares sum to %g, want %g", shares[0]+shares[1], deaths(15))
+	}
+}
+
+func TestShapleyWeights(t *testing.T) {
+	// Weights times the number of coalitions of each size sum to one
+	for n := 1; n <= 10; n++ {
+		w := ShapleyWeights(n)
+		var sum float64
+		binom := 1.0
+		for k := 0; k < n; k++ {
+			sum += w[k] * binom
+			binom = binom * float64(n-1-k) / float64(k+1)
+		}
+		if math.Abs(sum-1) > 1e-12 {
+			t.Errorf("n=%d: weights sum to %g", n, sum)
+		}
+	}
+}
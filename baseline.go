@@ -0,0 +1,319 @@
+package main
+
+// Cell inputs (population, age fractions, baseline mortality rates and
+// country adjustment factors) are read through a baselineStore, which decodes
+// and regrids each file once per run and, with cacheDir, saves the result so
+// that later runs on the same grid can skip the shapefile altogether. The
+// store also holds the regridding weights from each grid the inputs and
+// concentrations are on to the InMAP grid, which cacheDir keeps as well.
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/ctessum/geom"
+
+	"mortality/crs"
+	"mortality/ioformats"
+	"mortality/regrid"
+)
+
+// cacheVersion is part of every cache key. Change it when the cache format
+// or the way cell inputs are read or regridded changes, so that older cache
+// files are ignored.
+const cacheVersion = 2
+
+// cacheMagic starts every cache file
+var cacheMagic = []byte("AQHC")
+
+// baselineStore reads each cell input once, on first use, and keeps it for
+// every cause/age and every scenario of a batch that needs it. Age fractions
+// are shared by all causes, for example. It is safe for concurrent use. The
+// slices it returns are shared and must not be modified.
+type baselineStore struct {
+	inmapCells []geom.Polygonal
+	gridCRS    *crs.CRS // CRS of inmapCells; nil if unknown
+	config     Config
+
+	mu     sync.Mutex
+	fields map[cellFieldKey]*cellField
+
+	gridOnce sync.Once
+	gridHash []byte // Hash of totalPMFile, for cache keys
+	gridErr  error
+
+	regridWeights map[string]*gridWeights // By regrid.Hash of the old grid
+	inmapOnce     sync.Once
+	inmapHash     string // regrid.Hash of inmapCells
+}
+
+// cellFieldKey identifies a cell input
+type cellFieldKey struct {
+	file  string
+	field string
+	total bool // Regridded by area-weighted sum rather than mean
+}
+
+// gridWeights are the regridding weights from one grid to the InMAP grid,
+// computed or read on first use
+type gridWeights struct {
+	once sync.Once
+	w    *regrid.Weights
+}
+
+// cellField is a cell input on the InMAP grid, read on first use
+type cellField struct {
+	once sync.Once
+	data []float64
+	err  error
+}
+
+func newBaselineStore(inmapCells []geom.Polygonal, gridCRS *crs.CRS, config Config) *baselineStore {
+	return &baselineStore{
+		inmapCells:    inmapCells,
+		gridCRS:       gridCRS,
+		config:        config,
+		fields:        make(map[cellFieldKey]*cellField),
+		regridWeights: make(map[string]*gridWeights),
+	}
+}
+
+// get returns the age fraction, baseline mortality rate and country
+// adjustment factor for a cause/age on the InMAP grid
+func (s *baselineStore) get(cause, age string) (countryRegrid, allcausemort, ijhat []float64, err error) {
+	demogFile, acmortFile, ijhatFile := baselineFiles(cause, age, s.config)
+	if countryRegrid, err = s.cellData(demogFile, "RRs", false); err != nil { // Change name
+		return nil, nil, nil, err
+	}
+	if allcausemort, err = s.cellData(acmortFile, "RRs", false); err != nil { // Change name
+		return nil, nil, nil, err
+	}
+	if ijhat, err = s.cellData(ijhatFile, "RRs", false); err != nil { // Change name
+		return nil, nil, nil, err
+	}
+	return countryRegrid, allcausemort, ijhat, nil
+}
+
+// cellData returns a field of a shapefile of cell data on the InMAP grid, as
+// getCellData does, reading the file only the first time it is requested
+func (s *baselineStore) cellData(file, field string, total bool) ([]float64, error) {
+	k := cellFieldKey{file: file, field: field, total: total}
+	s.mu.Lock()
+	f, ok := s.fields[k]
+	if !ok {
+		f = &cellField{}
+		s.fields[k] = f
+	}
+	s.mu.Unlock()
+	f.once.Do(func() {
+		f.data, f.err = s.load(file, field, total)
+	})
+	return f.data, f.err
+}
+
+// load reads a cell input from the cache in cacheDir if it is there, and
+// otherwise with getCellData, adding it to the cache. Cache files that are
+// missing or unreadable are recreated.
+func (s *baselineStore) load(file, field string, total bool) ([]float64, error) {
+	if s.config.CacheDir == "" {
+		return s.getCellData(file, field, total)
+	}
+	key, err := s.cacheKey(file, field, total)
+	if err != nil {
+		return nil, err
+	}
+	name := strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+	cacheFile := filepath.Join(s.config.CacheDir, name+"_"+field+"_"+key+".bin")
+	if data, err := readCache(cacheFile, len(s.inmapCells)); err == nil {
+		fmt.Printf("Read %s from the cache\n", file)
+		return data, nil
+	}
+	data, err := s.getCellData(file, field, total)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeCache(cacheFile, data); err != nil {
+		// The run can go on without the cache
+		fmt.Printf("Could not cache %s: %v\n", file, err)
+	}
+	return data, nil
+}
+
+// weights returns the regridding weights from oldCells to the InMAP grid.
+// They are computed once per grid and, with cacheDir, saved under the hashes
+// of both grids, so later runs on the same grids read them instead.
+func (s *baselineStore) weights(oldCells []geom.Polygonal) *regrid.Weights {
+	key := regrid.Hash(oldCells)
+	s.mu.Lock()
+	g, ok := s.regridWeights[key]
+	if !ok {
+		g = &gridWeights{}
+		s.regridWeights[key] = g
+	}
+	s.mu.Unlock()
+	g.once.Do(func() {
+		g.w = s.loadWeights(key, oldCells)
+	})
+	return g.w
+}
+
+// loadWeights reads the regridding weights for a grid from cacheDir, or
+// computes them and saves them there
+func (s *baselineStore) loadWeights(oldHash string, oldCells []geom.Polygonal) *regrid.Weights {
+	if s.config.CacheDir == "" {
+		fmt.Printf("Computing regridding weights from %d cells to %d InMAP cells\n", len(oldCells), len(s.inmapCells))
+		return regrid.ComputeWeights(oldCells, s.inmapCells, s.area())
+	}
+	s.inmapOnce.Do(func() {
+		s.inmapHash = regrid.Hash(s.inmapCells)
+	})
+	filename := filepath.Join(s.config.CacheDir, "weights_"+oldHash[:32]+"_"+s.inmapHash[:32]+"_"+s.config.AreaWeighting+".bin")
+	if w, err := regrid.LoadWeights(filename); err == nil && w.NOld == len(oldCells) && w.NNew == len(s.inmapCells) {
+		fmt.Printf("Read regridding weights from %s\n", filename)
+		return w
+	}
+	fmt.Printf("Computing regridding weights from %d cells to %d InMAP cells\n", len(oldCells), len(s.inmapCells))
+	w := regrid.ComputeWeights(oldCells, s.inmapCells, s.area())
+	if err := saveWeights(w, filename); err != nil {
+		// The run can go on without the cache
+		fmt.Printf("Could not cache regridding weights: %v\n", err)
+	}
+	return w
+}
+
+// area returns the AreaFunc of the areaWeighting setting
+func (s *baselineStore) area() regrid.AreaFunc {
+	area, _ := regrid.AreaMethod(s.config.AreaWeighting)
+	return area
+}
+
+// saveWeights saves regridding weights under a temporary name and renames
+// them, like writeCache
+func saveWeights(w *regrid.Weights, filename string) error {
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	if err := w.Save(f.Name()); err != nil {
+		os.Remove(f.Name())
+		return &ioformats.FileError{File: f.Name(), Err: err}
+	}
+	return os.Rename(f.Name(), filename)
+}
+
+// cacheKey returns a hash of everything that determines a cell input on the
+// InMAP grid: the contents of its shapefile and of totalPMFile (including
+// their .prj files), the field,
+// how it is regridded, gridMismatch and areaWeighting
+func (s *baselineStore) cacheKey(file, field string, total bool) (string, error) {
+	s.gridOnce.Do(func() {
+		h := sha256.New()
+		s.gridErr = hashFiles(h, filepath.Join(s.config.DataDir, s.config.TotalPMFile))
+		s.gridHash = h.Sum(nil)
+	})
+	if s.gridErr != nil {
+		return "", s.gridErr
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "aqhealth cell input v%d\n%s\n%t\n%s\n%s\n", cacheVersion, field, total, s.config.GridMismatch, s.config.AreaWeighting)
+	h.Write(s.gridHash)
+	if err := hashFiles(h, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)[:16]), nil
+}
+
+// hashFiles writes the contents of a shapefile's .shp, .dbf and .prj files
+// to h. The .prj file is optional.
+func hashFiles(h io.Writer, shpFile string) error {
+	base := strings.TrimSuffix(shpFile, filepath.Ext(shpFile))
+	for _, name := range []string{base + ".shp", base + ".dbf", base + ".prj"} {
+		f, err := os.Open(name)
+		if os.IsNotExist(err) && strings.HasSuffix(name, ".prj") {
+			fmt.Fprintln(h, "no .prj")
+			continue
+		}
+		if err != nil {
+			return &ioformats.FileError{File: name, Err: err}
+		}
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return &ioformats.FileError{File: name, Err: err}
+		}
+	}
+	return nil
+}
+
+// readCache reads a cache file of nCells values
+func readCache(filename string, nCells int) ([]float64, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	header := len(cacheMagic) + 12
+	if len(b) < header || !bytes.Equal(b[:len(cacheMagic)], cacheMagic) {
+		return nil, &ioformats.FileError{File: filename, Err: errors.New("not a cache file")}
+	}
+	b = b[len(cacheMagic):]
+	if v := binary.LittleEndian.Uint32(b); v != cacheVersion {
+		return nil, &ioformats.FileError{File: filename, Err: fmt.Errorf("cache version %d instead of %d", v, cacheVersion)}
+	}
+	n := binary.LittleEndian.Uint64(b[4:])
+	b = b[12:]
+	if n != uint64(nCells) || len(b) != 8*nCells {
+		return nil, &ioformats.FileError{File: filename, Err: fmt.Errorf("%d values instead of %d", len(b)/8, nCells)}
+	}
+	data := make([]float64, nCells)
+	for i := range data {
+		data[i] = math.Float64frombits(binary.LittleEndian.Uint64(b[8*i:]))
+	}
+	return data, nil
+}
+
+// writeCache writes data to a cache file. It is written under a temporary
+// name and renamed, so that runs sharing cacheDir never see part of a file.
+func writeCache(filename string, data []float64) error {
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return err
+	}
+	b := make([]byte, len(cacheMagic)+12+8*len(data))
+	copy(b, cacheMagic)
+	p := b[len(cacheMagic):]
+	binary.LittleEndian.PutUint32(p, cacheVersion)
+	binary.LittleEndian.PutUint64(p[4:], uint64(len(data)))
+	p = p[12:]
+	for i, v := range data {
+		binary.LittleEndian.PutUint64(p[8*i:], math.Float64bits(v))
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return &ioformats.FileError{File: f.Name(), Err: err}
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return &ioformats.FileError{File: f.Name(), Err: err}
+	}
+	return os.Rename(f.Name(), filename)
+}
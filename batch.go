@@ -0,0 +1,316 @@
+package main
+
+// The batch subcommand runs one configuration against many result files,
+// reading the grid, population, concentration-response parameters and
+// baseline inputs once and sharing them between the scenarios.
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"mortality/ioformats"
+)
+
+var (
+	manifest     = flag.String("manifest", "", "batch: CSV of scenarios with a resultFile column and optional per-scenario overrides")
+	workers      = flag.Int("workers", 0, "batch: Number of scenarios to run at once (0 = number of CPUs)")
+	batchSummary = flag.String("batchSummary", "batch_summary.csv", "batch: CSV in outputDir of the output totals of every scenario")
+)
+
+// batchScenario is one result file of a batch and its settings
+type batchScenario struct {
+	name   string
+	config Config
+}
+
+// manifestColumns are the settings a manifest can override for each
+// scenario. Anything else would change the shared inputs.
+var manifestColumns = map[string]func(c *Config, v string) error{
+	"resultFile": func(c *Config, v string) error { c.ResultFile = v; return nil },
+	"shpVarName": func(c *Config, v string) error { c.ShpVarName = v; return nil },
+	"ncVarName":  func(c *Config, v string) error { c.NCVarName = v; return nil },
+	"ncLayer": func(c *Config, v string) (err error) {
+		c.NCLayer, err = strconv.Atoi(v)
+		return err
+	},
+	"ncTime": func(c *Config, v string) (err error) {
+		c.NCTime, err = strconv.Atoi(v)
+		return err
+	},
+	"attributionMethod": func(c *Config, v string) error {
+		if v != "proportional" && v != "zeroout" && v != "scenario" {
+			return fmt.Errorf("must be 'proportional', 'zeroout' or 'scenario'")
+		}
+		c.AttributionMethod = v
+		return nil
+	},
+	"baselineFile": func(c *Config, v string) error { c.BaselineFile = v; return nil },
+	"outputFile":   func(c *Config, v string) error { c.OutputFile = v; return nil },
+}
+
+// runBatch runs the configuration given by args against every result file
+// named by the arguments after the flags (files or glob patterns) or by the
+// -manifest CSV. Each scenario writes its outputs to a directory of its own
+// in outputDir, and the totals of every output field are collected in the
+// -batchSummary table. A failed scenario does not stop the others.
+func runBatch(args []string) error {
+	config, err := loadConfig(args)
+	if err != nil {
+		return err
+	}
+	if len(config.Sources) > 0 || config.OutputSpec.Mode == "lifetable" {
+		return configErrorf("", "the batch subcommand cannot be used with sources or the lifetable mode")
+	}
+	if *validate {
+		return configErrorf("validate", "-validate is not supported by the batch subcommand; validate a scenario with run")
+	}
+	scenarios, err := batchScenarios(config, *manifest, flag.Args())
+	if err != nil {
+		return err
+	}
+	for _, sc := range scenarios {
+		if err := checkOutputGrid(sc.config); err != nil {
+			return fmt.Errorf("scenario %s: %w", sc.name, err)
+		}
+	}
+	if err := os.MkdirAll(config.OutputDir, 0755); err != nil {
+		return err
+	}
+
+	fmt.Printf("Running %d scenarios\n", len(scenarios))
+	fmt.Println("reading shared inputs")
+	if config.Year != 0 {
+		fmt.Printf("Using %s %d projections of population and baseline mortality\n", config.Scenario, config.Year)
+	}
+	in, err := loadSharedInputs(config)
+	if err != nil {
+		return err
+	}
+
+	n := *workers
+	if n <= 0 {
+		n = runtime.NumCPU()
+	}
+	totals := make([][]outputTotal, len(scenarios))
+	errs := make([]error, len(scenarios))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < n; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				sc := scenarios[i]
+				fmt.Printf("[%s] starting: %s\n", sc.name, sc.config.ResultFile)
+				if err := os.MkdirAll(sc.config.OutputDir, 0755); err != nil {
+					errs[i] = err
+				} else {
+					totals[i], errs[i] = runScenario(in, sc.config)
+				}
+				if errs[i] != nil {
+					fmt.Printf("[%s] failed: %v\n", sc.name, errs[i])
+				} else {
+					fmt.Printf("[%s] done\n", sc.name)
+				}
+			}
+		}()
+	}
+	for i := range scenarios {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+
+	if err := writeBatchSummary(filepath.Join(config.OutputDir, *batchSummary), scenarios, totals, errs); err != nil {
+		return err
+	}
+	var failed []error
+	for i, err := range errs {
+		if err != nil {
+			failed = append(failed, fmt.Errorf("scenario %s: %w", scenarios[i].name, err))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%d of %d scenarios failed, the first: %w", len(failed), len(scenarios), failed[0])
+	}
+	fmt.Printf("All %d scenarios finished\n", len(scenarios))
+	return nil
+}
+
+// batchScenarios lists the scenarios of a batch, from the manifest if there
+// is one and otherwise from the result files and glob patterns in args. Each
+// scenario's outputs go to outputDir/<name>.
+func batchScenarios(config Config, manifestFile string, args []string) ([]batchScenario, error) {
+	var scenarios []batchScenario
+	if manifestFile != "" {
+		if len(args) > 0 {
+			return nil, configErrorf("manifest", "give either -manifest or result files, not both")
+		}
+		var err error
+		if scenarios, err = readManifest(config, manifestFile); err != nil {
+			return nil, err
+		}
+	} else {
+		var files []string
+		for _, a := range args {
+			matches, err := filepath.Glob(a)
+			if err != nil {
+				return nil, configErrorf("", "result file pattern %s: %v", a, err)
+			}
+			if len(matches) == 0 {
+				return nil, &ioformats.FileError{File: a, Err: errors.New("no result files match")}
+			}
+			files = append(files, matches...)
+		}
+		if len(files) == 0 {
+			return nil, configErrorf("", "batch requires result files, glob patterns or -manifest")
+		}
+		names := scenarioNames(files)
+		for i, f := range files {
+			sc := batchScenario{name: names[i], config: config}
+			sc.config.ResultFile = f
+			scenarios = append(scenarios, sc)
+		}
+	}
+
+	seen := make(map[string]bool)
+	for i := range scenarios {
+		sc := &scenarios[i]
+		if seen[sc.name] {
+			return nil, configErrorf("", "duplicate scenario name %s; name the scenarios in a -manifest", sc.name)
+		}
+		seen[sc.name] = true
+		sc.config.OutputDir = filepath.Join(config.OutputDir, sc.name)
+	}
+	return scenarios, nil
+}
+
+// readManifest reads a CSV of scenarios, one per row. The header names the
+// settings in manifestColumns, plus an optional name column; resultFile is
+// required. Empty cells keep the value from the configuration.
+func readManifest(config Config, filename string) ([]batchScenario, error) {
+	lines, err := ioformats.ReadCSV(filename)
+	if err != nil {
+		return nil, configError{err: err}
+	}
+	if len(lines) < 2 {
+		return nil, configError{err: &ioformats.FileError{File: filename, Err: errors.New("manifest has no scenarios")}}
+	}
+	header := lines[0]
+	nameCol, resultCol := -1, -1
+	for j, col := range header {
+		if col == "name" {
+			nameCol = j
+			continue
+		}
+		if manifestColumns[col] == nil {
+			return nil, configError{err: &ioformats.FileError{File: filename, Row: 1, Field: col,
+				Err: fmt.Errorf("unknown column; must be name or one of %s", strings.Join(manifestColumnNames(), ", "))}}
+		}
+		if col == "resultFile" {
+			resultCol = j
+		}
+	}
+	if resultCol < 0 {
+		return nil, configError{err: &ioformats.FileError{File: filename, Row: 1, Err: errors.New("no resultFile column")}}
+	}
+
+	var files []string
+	for _, line := range lines[1:] {
+		files = append(files, line[resultCol])
+	}
+	names := scenarioNames(files)
+
+	var scenarios []batchScenario
+	for i, line := range lines[1:] {
+		sc := batchScenario{name: names[i], config: config}
+		for j, v := range line {
+			v = strings.TrimSpace(v)
+			if v == "" {
+				continue
+			}
+			if j == nameCol {
+				sc.name = v
+				continue
+			}
+			if err := manifestColumns[header[j]](&sc.config, v); err != nil {
+				return nil, configError{err: &ioformats.FileError{File: filename, Row: i + 2, Field: header[j], Err: err}}
+			}
+		}
+		if strings.TrimSpace(line[resultCol]) == "" {
+			return nil, configError{err: &ioformats.FileError{File: filename, Row: i + 2, Field: "resultFile", Err: errors.New("missing")}}
+		}
+		if sc.name == "" || strings.ContainsAny(sc.name, `/\`) {
+			return nil, configError{err: &ioformats.FileError{File: filename, Row: i + 2, Field: "name", Err: fmt.Errorf("invalid scenario name %q", sc.name)}}
+		}
+		scenarios = append(scenarios, sc)
+	}
+	return scenarios, nil
+}
+
+// manifestColumnNames lists the manifest override columns in order
+func manifestColumnNames() []string {
+	var names []string
+	for name := range manifestColumns {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// scenarioNames names each result file by its path without the directory
+// all the files share and without its extension, with the remaining
+// directories joined by "_". Files in one directory are named by their base
+// names, and results/energy/inmap_output.shp and
+// results/agri/inmap_output.shp become energy_inmap_output and
+// agri_inmap_output.
+func scenarioNames(files []string) []string {
+	dirs := make([][]string, len(files))
+	common := -1
+	for i, f := range files {
+		dirs[i] = strings.Split(filepath.ToSlash(filepath.Dir(filepath.Clean(f))), "/")
+		if i == 0 {
+			common = len(dirs[0])
+			continue
+		}
+		n := 0
+		for n < common && n < len(dirs[i]) && dirs[i][n] == dirs[0][n] {
+			n++
+		}
+		common = n
+	}
+	names := make([]string, len(files))
+	for i, f := range files {
+		base := strings.TrimSuffix(filepath.Base(f), filepath.Ext(f))
+		names[i] = strings.Join(append(dirs[i][common:], base), "_")
+	}
+	return names
+}
+
+// writeBatchSummary writes one row per output field of each scenario with
+// its total over all cells, or one row with the error of a failed scenario
+func writeBatchSummary(filename string, scenarios []batchScenario, totals [][]outputTotal, errs []error) error {
+	rows := [][]string{{"scenario", "result_file", "status", "output", "field", "total", "error"}}
+	for i, sc := range scenarios {
+		if errs[i] != nil {
+			rows = append(rows, []string{sc.name, sc.config.ResultFile, "error", "", "", "", errs[i].Error()})
+			continue
+		}
+		for _, t := range totals[i] {
+			rows = append(rows, []string{sc.name, sc.config.ResultFile, "ok", t.file, t.field, strconv.FormatFloat(t.total, 'g', -1, 64), ""})
+		}
+	}
+	if err := writeCSV(filename, rows); err != nil {
+		return err
+	}
+	fmt.Printf("Batch summary written to %s\n", filename)
+	return nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"mortality/ioformats"
+)
+
+func TestReadManifest(t *testing.T) {
+	dir := t.TempDir()
+	manifest := filepath.Join(dir, "manifest.csv")
+	write := func(s string) {
+		if err := os.WriteFile(manifest, []byte(s), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	config := defaultConfig()
+	config.NCVarName = "PM25"
+	config.AttributionMethod = "proportional"
+
+	write("name,resultFile,ncVarName,ncLayer,ncTime,attributionMethod\n" +
+		"energy,results/energy.nc,,2,3,zeroout\n" +
+		",results/agri/out.nc, TotalPM25 ,,,\n")
+	scenarios, err := readManifest(config, manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(scenarios) != 2 {
+		t.Fatalf("read %d scenarios, want 2", len(scenarios))
+	}
+	// Overrides apply to their own row only; empty cells keep the
+	// configuration's value
+	a, b := scenarios[0], scenarios[1]
+	if a.name != "energy" || a.config.ResultFile != "results/energy.nc" || a.config.NCVarName != "PM25" ||
+		a.config.NCLayer != 2 || a.config.NCTime != 3 || a.config.AttributionMethod != "zeroout" {
+		t.Errorf("first scenario %s: %+v", a.name, a.config)
+	}
+	if b.name != "agri_out" || b.config.ResultFile != "results/agri/out.nc" || b.config.NCVarName != "TotalPM25" ||
+		b.config.NCLayer != config.NCLayer || b.config.AttributionMethod != "proportional" {
+		t.Errorf("second scenario %s: %+v", b.name, b.config)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		manifest string
+		row      int
+		field    string
+	}{
+		{"unknown column", "resultFile,popFile\na.nc,pop.shp\n", 1, "popFile"},
+		{"no resultFile column", "name,ncVarName\na,PM25\n", 1, ""},
+		{"empty resultFile", "name,resultFile\na,\n", 2, "resultFile"},
+		{"bad ncLayer", "resultFile,ncLayer\na.nc,1\nb.nc,top\n", 3, "ncLayer"},
+		{"bad attributionMethod", "resultFile,attributionMethod\na.nc,shapley\n", 2, "attributionMethod"},
+		{"name with a path", "name,resultFile\nx/y,a.nc\n", 2, "name"},
+		{"no scenarios", "resultFile\n", 0, ""},
+	} {
+		write(tc.manifest)
+		_, err := readManifest(config, manifest)
+		var ce configError
+		var fe *ioformats.FileError
+		if !errors.As(err, &ce) || !errors.As(err, &fe) {
+			t.Errorf("%s: error %v, want a configError wrapping a FileError", tc.name, err)
+			continue
+		}
+		if fe.Row != tc.row || fe.Field != tc.field {
+			t.Errorf("%s: error at row %d, field %q; want row %d, field %q", tc.name, fe.Row, fe.Field, tc.row, tc.field)
+		}
+	}
+}
+
+func TestScenarioNames(t *testing.T) {
+	for _, tc := range []struct {
+		files, want []string
+	}{
+		{[]string{"results/a.shp", "results/b.shp"}, []string{"a", "b"}},
+		{[]string{"results/energy/inmap_output.shp", "results/agri/inmap_output.shp"}, []string{"energy_inmap_output", "agri_inmap_output"}},
+		{[]string{"results/x/y/out.nc", "results/z.nc"}, []string{"x_y_out", "z"}},
+	} {
+		got := scenarioNames(tc.files)
+		for i := range tc.want {
+			if got[i] != tc.want[i] {
+				t.Errorf("scenarioNames(%v) = %v, want %v", tc.files, got, tc.want)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,372 @@
+// Package crf implements concentration-response functions relating long-term
+// PM2.5 exposure to the relative risk of death: the Global Exposure Mortality
+// Model (GEMM), the Integrated Exposure-Response function (IER), log-linear
+// functions and tabulated Fusion curves.
+package crf
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Function is a concentration-response function for one cause/age
+type Function interface {
+	// RR returns the relative risk at PM2.5 concentration z (μg/m³)
+	// compared with the counterfactual concentration
+	RR(z float64) float64
+	// Sample returns a copy with its uncertain parameters drawn from their
+	// sampling distribution, for Monte Carlo analysis
+	Sample(rng *rand.Rand) Function
+	// WithCounterfactual returns a copy using counterfactual concentration cf
+	WithCounterfactual(cf float64) Function
+}
+
+// Key identifies the cause of death and age group of a function
+type Key struct {
+	Cause string
+	Age   string
+}
+
+// Entry is one cause/age of a concentration-response parameter table
+type Entry struct {
+	Key      Key
+	Function Function
+}
+
+// Kinds lists the supported kinds of function, as accepted by Parse
+var Kinds = []string{"gemm", "ier", "loglinear", "fusion"}
+
+// Parse reads a parameter table of the given kind ("gemm", "ier",
+// "loglinear" or "fusion") from CSV records, the first of which is a header.
+// The counterfactual concentration of every function is zero until set with
+// WithCounterfactual.
+func Parse(kind string, records [][]string) ([]Entry, error) {
+	switch kind {
+	case "gemm":
+		return ParseGEMM(records)
+	case "ier":
+		return ParseIER(records)
+	case "loglinear":
+		return ParseLogLinear(records)
+	case "fusion":
+		return ParseFusion(records)
+	default:
+		return nil, fmt.Errorf("unknown concentration-response function %q: must be one of %s", kind, strings.Join(Kinds, ", "))
+	}
+}
+
+// WithCounterfactual sets the counterfactual concentration of every entry
+func WithCounterfactual(entries []Entry, cf float64) {
+	for i := range entries {
+		entries[i].Function = entries[i].Function.WithCounterfactual(cf)
+	}
+}
+
+// Map indexes a parameter table by cause and age
+func Map(entries []Entry) map[Key]Function {
+	m := make(map[Key]Function)
+	for _, e := range entries {
+		m[e.Key] = e.Function
+	}
+	return m
+}
+
+// Lookup returns the function for a cause and age. Parameter tables are
+// short, so it searches entries rather than building a Map on every call.
+func Lookup(entries []Entry, cause, age string) (Function, error) {
+	for _, e := range entries {
+		if e.Key == (Key{cause, age}) {
+			return e.Function, nil
+		}
+	}
+	return nil, fmt.Errorf("no concentration-response parameters for cause=%s, age=%s", cause, age)
+}
+
+// GEMM returns the relative risk at concentration z from the Global Exposure
+// Mortality Model (Burnett et al. 2018) with counterfactual concentration cf
+func GEMM(z, cf, θ, α, μ, v float64) float64 {
+	z = math.Max(z-cf, 0)
+	denom := 1.0 + math.Exp(-(z-μ)/v)
+	numer := θ * math.Log((z/α)+1)
+	return math.Exp(numer / denom)
+}
+
+// GEMMParams are the parameters of the Global Exposure Mortality Model
+// (Burnett et al. 2018)
+type GEMMParams struct {
+	Theta float64
+	Alpha float64
+	Mu    float64
+	V     float64
+	SE    float64 // Standard error of Theta
+	CF    float64 // Counterfactual concentration
+}
+
+// RR implements Function
+func (p GEMMParams) RR(z float64) float64 {
+	return GEMM(z, p.CF, p.Theta, p.Alpha, p.Mu, p.V)
+}
+
+// WithCounterfactual implements Function
+func (p GEMMParams) WithCounterfactual(cf float64) Function {
+	p.CF = cf
+	return p
+}
+
+// Sample draws Theta from a normal distribution with its standard error
+func (p GEMMParams) Sample(rng *rand.Rand) Function {
+	p.Theta += p.SE * rng.NormFloat64()
+	return p
+}
+
+// ParseGEMM reads GEMM parameters with columns cause, age, θ, se(θ), α, μ, v
+func ParseGEMM(records [][]string) ([]Entry, error) {
+	var entries []Entry
+	for i, line := range records {
+		if i == 0 { // omit header line
+			continue
+		}
+		var p GEMMParams
+		for j, dst := range []*float64{&p.Theta, &p.SE, &p.Alpha, &p.Mu, &p.V} {
+			v, err := parseField(line, i, j+2)
+			if err != nil {
+				return nil, err
+			}
+			*dst = v
+		}
+		entries = append(entries, Entry{Key{line[0], line[1]}, p})
+	}
+	return entries, nil
+}
+
+// IERParams are the parameters of the Integrated Exposure-Response function
+// (Burnett et al. 2014): RR = 1 + α(1 - exp(-γ Δz^δ))
+type IERParams struct {
+	Alpha float64
+	Gamma float64
+	Delta float64
+	CF    float64 // Counterfactual concentration
+}
+
+// RR implements Function
+func (p IERParams) RR(z float64) float64 {
+	dz := math.Max(z-p.CF, 0)
+	return 1 + p.Alpha*(1-math.Exp(-p.Gamma*math.Pow(dz, p.Delta)))
+}
+
+// WithCounterfactual implements Function
+func (p IERParams) WithCounterfactual(cf float64) Function {
+	p.CF = cf
+	return p
+}
+
+// Sample returns p unchanged: the IER is published as sets of parameter draws
+// rather than standard errors, so no sampling distribution is available here
+func (p IERParams) Sample(rng *rand.Rand) Function {
+	return p
+}
+
+// ParseIER reads IER parameters with columns cause, age, α, γ, δ
+func ParseIER(records [][]string) ([]Entry, error) {
+	var entries []Entry
+	for i, line := range records {
+		if i == 0 { // omit header line
+			continue
+		}
+		var p IERParams
+		for j, dst := range []*float64{&p.Alpha, &p.Gamma, &p.Delta} {
+			v, err := parseField(line, i, j+2)
+			if err != nil {
+				return nil, err
+			}
+			*dst = v
+		}
+		entries = append(entries, Entry{Key{line[0], line[1]}, p})
+	}
+	return entries, nil
+}
+
+// LogLinearParams are the parameters of a log-linear function as used for
+// the American Cancer Society cohort (Krewski et al. 2009): RR = exp(β Δz)
+type LogLinearParams struct {
+	Beta float64
+	SE   float64 // Standard error of Beta
+	CF   float64 // Counterfactual concentration
+}
+
+// RR implements Function
+func (p LogLinearParams) RR(z float64) float64 {
+	return math.Exp(p.Beta * math.Max(z-p.CF, 0))
+}
+
+// WithCounterfactual implements Function
+func (p LogLinearParams) WithCounterfactual(cf float64) Function {
+	p.CF = cf
+	return p
+}
+
+// Sample draws Beta from a normal distribution with its standard error
+func (p LogLinearParams) Sample(rng *rand.Rand) Function {
+	p.Beta += p.SE * rng.NormFloat64()
+	return p
+}
+
+// ParseLogLinear reads log-linear parameters with columns cause, age, β, se(β)
+func ParseLogLinear(records [][]string) ([]Entry, error) {
+	var entries []Entry
+	for i, line := range records {
+		if i == 0 { // omit header line
+			continue
+		}
+		var p LogLinearParams
+		for j, dst := range []*float64{&p.Beta, &p.SE} {
+			v, err := parseField(line, i, j+2)
+			if err != nil {
+				return nil, err
+			}
+			*dst = v
+		}
+		entries = append(entries, Entry{Key{line[0], line[1]}, p})
+	}
+	return entries, nil
+}
+
+// FusionCurve is a tabulated relative risk curve, as published for the Fusion
+// model (Burnett et al. 2022). Log relative risk is interpolated linearly
+// between the tabulated concentrations and held constant beyond them.
+type FusionCurve struct {
+	Concs []float64 // Ascending
+	LogRR []float64
+	LogSE []float64 // Standard error of log RR, derived from the 95% interval; nil if not given
+	CF    float64   // Counterfactual concentration
+}
+
+func (c FusionCurve) logRRAt(z float64) float64 {
+	n := len(c.Concs)
+	if z <= c.Concs[0] {
+		return c.LogRR[0]
+	}
+	if z >= c.Concs[n-1] {
+		return c.LogRR[n-1]
+	}
+	i := sort.SearchFloat64s(c.Concs, z)
+	frac := (z - c.Concs[i-1]) / (c.Concs[i] - c.Concs[i-1])
+	return c.LogRR[i-1] + frac*(c.LogRR[i]-c.LogRR[i-1])
+}
+
+// RR returns the tabulated relative risk at z relative to that at the counterfactual
+func (c FusionCurve) RR(z float64) float64 {
+	return math.Exp(c.logRRAt(math.Max(z, c.CF)) - c.logRRAt(c.CF))
+}
+
+// WithCounterfactual implements Function
+func (c FusionCurve) WithCounterfactual(cf float64) Function {
+	c.CF = cf
+	return c
+}
+
+// Sample shifts the whole curve by one normal draw scaled by the standard
+// error of log RR at each concentration
+func (c FusionCurve) Sample(rng *rand.Rand) Function {
+	if c.LogSE == nil {
+		return c
+	}
+	u := rng.NormFloat64()
+	s := FusionCurve{Concs: c.Concs, LogRR: make([]float64, len(c.LogRR)), CF: c.CF}
+	for i := range c.LogRR {
+		s.LogRR[i] = c.LogRR[i] + u*c.LogSE[i]
+	}
+	return s
+}
+
+// ParseFusion reads a tabulated Fusion curve with columns cause, age,
+// concentration, rr and optionally rr_lower, rr_upper (95% interval).
+// Rows for each cause/age must be in ascending order of concentration.
+func ParseFusion(records [][]string) ([]Entry, error) {
+	curves := make(map[Key]*FusionCurve)
+	var order []Key
+	for i, line := range records {
+		if i == 0 { // omit header line
+			continue
+		}
+		if len(line) < 4 {
+			return nil, &RowError{Row: i + 1, Err: fmt.Errorf("expected at least 4 columns, got %d", len(line))}
+		}
+		key := Key{line[0], line[1]}
+		c, ok := curves[key]
+		if !ok {
+			c = &FusionCurve{}
+			curves[key] = c
+			order = append(order, key)
+		}
+		conc, err := parseField(line, i, 2)
+		if err != nil {
+			return nil, err
+		}
+		if n := len(c.Concs); n > 0 && conc <= c.Concs[n-1] {
+			return nil, &RowError{Row: i + 1, Column: 3, Err: fmt.Errorf("Fusion concentrations for cause=%s, age=%s must be ascending", key.Cause, key.Age)}
+		}
+		rr, err := parseField(line, i, 3)
+		if err != nil {
+			return nil, err
+		}
+		c.Concs = append(c.Concs, conc)
+		c.LogRR = append(c.LogRR, math.Log(rr))
+		if len(line) == 5 {
+			return nil, &RowError{Row: i + 1, Column: 6, Err: errors.New("rr_lower is given without rr_upper")}
+		}
+		if len(line) > 5 {
+			lower, err := parseField(line, i, 4)
+			if err != nil {
+				return nil, err
+			}
+			upper, err := parseField(line, i, 5)
+			if err != nil {
+				return nil, err
+			}
+			c.LogSE = append(c.LogSE, (math.Log(upper)-math.Log(lower))/(2*1.96))
+		}
+	}
+	var entries []Entry
+	for _, key := range order {
+		c := curves[key]
+		if c.LogSE != nil && len(c.LogSE) != len(c.LogRR) {
+			return nil, fmt.Errorf("Fusion intervals for cause=%s, age=%s must be given for all or no rows", key.Cause, key.Age)
+		}
+		entries = append(entries, Entry{key, *c})
+	}
+	return entries, nil
+}
+
+// parseField parses column j of record i (0-based, including the header) as a float
+func parseField(line []string, i, j int) (float64, error) {
+	if j >= len(line) {
+		return 0, &RowError{Row: i + 1, Column: j + 1, Err: errors.New("missing column")}
+	}
+	v, err := strconv.ParseFloat(strings.TrimSpace(line[j]), 64)
+	if err != nil {
+		return 0, &RowError{Row: i + 1, Column: j + 1, Err: err}
+	}
+	return v, nil
+}
+
+// RowError is an error in one row of a parameter table
+type RowError struct {
+	Row    int // 1-based, counting the header
+	Column int // 1-based; 0 if the error is not in a particular column
+	Err    error
+}
+
+func (e *RowError) Error() string {
+	if e.Column == 0 {
+		return fmt.Sprintf("row %d: %v", e.Row, e.Err)
+	}
+	return fmt.Sprintf("row %d, column %d: %v", e.Row, e.Column, e.Err)
+}
+
+func (e *RowError) Unwrap() error { return e.Err }
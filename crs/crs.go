@@ -0,0 +1,223 @@
+// Package crs describes the coordinate reference systems of gridded inputs
+// and reprojects cells between them. It supports longitude/latitude, Lambert
+// conformal conic, Albers equal-area conic and Mercator (including Web
+// Mercator) coordinates, read from WKT as found in shapefile .prj files and
+// GeoPackages, or from a few EPSG codes. Anything else is an error rather
+// than being taken for one of these.
+//
+// Datums are not converted: longitudes and latitudes are carried between
+// systems unchanged, which moves points by at most a few hundred metres.
+package crs
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/ctessum/geom"
+)
+
+// Kind is the projection of a coordinate reference system
+type Kind int
+
+const (
+	LongLat  Kind = iota // Longitude and latitude in degrees
+	LCC                  // Lambert conformal conic
+	Albers               // Albers equal-area conic
+	Mercator             // Mercator; Web Mercator is Mercator on a sphere
+)
+
+var kindNames = map[Kind]string{
+	LongLat:  "longitude/latitude",
+	LCC:      "Lambert conformal conic",
+	Albers:   "Albers equal-area conic",
+	Mercator: "Mercator",
+}
+
+// Ellipsoid is the figure of the Earth a CRS is defined on
+type Ellipsoid struct {
+	A float64 // Semi-major axis in metres
+	F float64 // Flattening; 0 for a sphere
+}
+
+// CRS is a coordinate reference system. Angles are in degrees and projected
+// coordinates in units of ToMeter metres.
+type CRS struct {
+	Name string
+	WKT  string // Definition it was read from, if any
+	Kind Kind
+	Ellipsoid
+
+	Lat0, Lon0                  float64 // Origin of the projection
+	Lat1, Lat2                  float64 // Standard parallels (LCC and Albers) or the latitude of true scale (Mercator)
+	K0                          float64 // Scale factor at the standard parallel or the equator
+	FalseEasting, FalseNorthing float64 // In metres
+	ToMeter                     float64 // Length of a projected unit in metres
+}
+
+// WGS84 is longitude/latitude on the WGS 84 ellipsoid, the CRS of NetCDF
+// inputs and outputs and of GeoPackage outputs
+var WGS84 = &CRS{
+	Name:      "WGS 84",
+	WKT:       `GEOGCS["WGS 84",DATUM["WGS_1984",SPHEROID["WGS 84",6378137,298.257223563]],PRIMEM["Greenwich",0],UNIT["degree",0.0174532925199433],AUTHORITY["EPSG","4326"]]`,
+	Kind:      LongLat,
+	Ellipsoid: Ellipsoid{A: 6378137, F: 1 / 298.257223563},
+}
+
+// Geographic reports whether coordinates are longitudes and latitudes
+func (c *CRS) Geographic() bool {
+	return c.Kind == LongLat
+}
+
+// String describes the CRS by its name, projection and parameters
+func (c *CRS) String() string {
+	name := c.Name
+	if name == "" {
+		name = "unnamed"
+	}
+	switch c.Kind {
+	case LCC, Albers:
+		return fmt.Sprintf("%s (%s, standard parallels %g and %g, origin %g, %g)", name, kindNames[c.Kind], c.Lat1, c.Lat2, c.Lat0, c.Lon0)
+	case Mercator:
+		return fmt.Sprintf("%s (%s, central meridian %g)", name, kindNames[c.Kind], c.Lon0)
+	}
+	return fmt.Sprintf("%s (%s)", name, kindNames[c.Kind])
+}
+
+// Equal reports whether two CRSs have the same coordinates. Longitudes and
+// latitudes are equal whatever their ellipsoid, since datums are not
+// converted.
+func (c *CRS) Equal(o *CRS) bool {
+	if c.Kind != o.Kind {
+		return false
+	}
+	if c.Kind == LongLat {
+		return true
+	}
+	near := func(a, b, tol float64) bool { return math.Abs(a-b) <= tol }
+	return near(c.A, o.A, 1e-3) && near(c.F, o.F, 1e-12) &&
+		near(c.Lat0, o.Lat0, 1e-9) && near(c.Lon0, o.Lon0, 1e-9) &&
+		near(c.Lat1, o.Lat1, 1e-9) && near(c.Lat2, o.Lat2, 1e-9) &&
+		near(c.K0, o.K0, 1e-12) && near(c.ToMeter, o.ToMeter, 1e-12) &&
+		near(c.FalseEasting, o.FalseEasting, 1e-6) && near(c.FalseNorthing, o.FalseNorthing, 1e-6)
+}
+
+// FromEPSG returns the CRS with an EPSG (or ESRI) code, for the codes in
+// common use for global and North American grids
+func FromEPSG(code int) (*CRS, error) {
+	grs80 := Ellipsoid{A: 6378137, F: 1 / 298.257222101}
+	switch code {
+	case 4326:
+		return WGS84, nil
+	case 4269:
+		return &CRS{Name: "NAD83", Kind: LongLat, Ellipsoid: grs80}, nil
+	case 4258:
+		return &CRS{Name: "ETRS89", Kind: LongLat, Ellipsoid: grs80}, nil
+	case 3857, 900913, 3785, 102100, 102113:
+		return &CRS{Name: "WGS 84 / Pseudo-Mercator", Kind: Mercator, Ellipsoid: Ellipsoid{A: 6378137}, K0: 1, ToMeter: 1}, nil
+	case 5070:
+		return &CRS{Name: "NAD83 / Conus Albers", Kind: Albers, Ellipsoid: grs80,
+			Lat0: 23, Lon0: -96, Lat1: 29.5, Lat2: 45.5, K0: 1, ToMeter: 1}, nil
+	case 102004:
+		return &CRS{Name: "USA Contiguous Lambert Conformal Conic", Kind: LCC, Ellipsoid: Ellipsoid{A: 6378137, F: 1 / 298.257223563},
+			Lat0: 39, Lon0: -96, Lat1: 33, Lat2: 45, K0: 1, ToMeter: 1}, nil
+	}
+	return nil, fmt.Errorf("unsupported EPSG code %d", code)
+}
+
+// Transform returns a function that converts points from one CRS to another
+func Transform(from, to *CRS) (func(geom.Point) geom.Point, error) {
+	fp, err := from.projection()
+	if err != nil {
+		return nil, err
+	}
+	tp, err := to.projection()
+	if err != nil {
+		return nil, err
+	}
+	return func(p geom.Point) geom.Point {
+		lon, lat := fp.inverse(p.X, p.Y)
+		x, y := tp.forward(lon, lat)
+		return geom.Point{X: x, Y: y}
+	}, nil
+}
+
+// densify controls how finely edges are split when they are reprojected: an
+// edge is halved while its midpoint lands more than densifyTol of its length
+// away from the straight line, up to densifyDepth times.
+const (
+	densifyTol   = 1e-3
+	densifyDepth = 5
+)
+
+// Reproject converts cells from one CRS to another. Edges that would bend
+// (such as parallels projected onto a cone) are split so that the cells keep
+// their shape. Cells in longitude/latitude are first moved by whole turns to
+// within 180° of the central meridian of the projection, so that grids from
+// 0 to 360° and from -180 to 180° land in the same place, without splitting
+// any cell. The cells are returned unchanged if either CRS is nil (unknown)
+// or the two are equal.
+func Reproject(cells []geom.Polygonal, from, to *CRS) ([]geom.Polygonal, error) {
+	if from == nil || to == nil || from.Equal(to) {
+		return cells, nil
+	}
+	t, err := Transform(from, to)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]geom.Polygonal, len(cells))
+	for i, c := range cells {
+		polys := c.Polygons()
+		mp := make(geom.MultiPolygon, len(polys))
+		for j, p := range polys {
+			shift := 0.0
+			if from.Geographic() && !to.Geographic() && len(p) > 0 && len(p[0]) > 0 {
+				shift = -360 * math.Floor((p[0][0].X-to.Lon0+180)/360)
+			}
+			mp[j] = make(geom.Polygon, len(p))
+			for k, ring := range p {
+				mp[j][k] = densifyRing(ring, shift, t)
+			}
+		}
+		if _, ok := c.(geom.Polygon); ok && len(mp) == 1 {
+			out[i] = mp[0]
+		} else {
+			out[i] = mp
+		}
+	}
+	return out, nil
+}
+
+// densifyRing transforms a ring, after adding shift to its x coordinates,
+// splitting its edges as needed
+func densifyRing(ring []geom.Point, shift float64, t func(geom.Point) geom.Point) []geom.Point {
+	if len(ring) == 0 {
+		return nil
+	}
+	at := func(i int) geom.Point { return geom.Point{X: ring[i].X + shift, Y: ring[i].Y} }
+	out := make([]geom.Point, 0, len(ring))
+	tp := t(at(0))
+	out = append(out, tp)
+	for i := 1; i < len(ring); i++ {
+		tq := t(at(i))
+		out = densifyEdge(out, at(i-1), at(i), tp, tq, t, 0)
+		out = append(out, tq)
+		tp = tq
+	}
+	return out
+}
+
+// densifyEdge appends the transformed points strictly between p and q
+func densifyEdge(out []geom.Point, p, q, tp, tq geom.Point, t func(geom.Point) geom.Point, depth int) []geom.Point {
+	if depth >= densifyDepth {
+		return out
+	}
+	m := geom.Point{X: (p.X + q.X) / 2, Y: (p.Y + q.Y) / 2}
+	tm := t(m)
+	dev := math.Hypot(tm.X-(tp.X+tq.X)/2, tm.Y-(tp.Y+tq.Y)/2)
+	if !(dev > densifyTol*math.Hypot(tq.X-tp.X, tq.Y-tp.Y)) {
+		return out
+	}
+	out = densifyEdge(out, p, m, tp, tm, t, depth+1)
+	out = append(out, tm)
+	return densifyEdge(out, m, q, tm, tq, t, depth+1)
+}
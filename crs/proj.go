@@ -0,0 +1,227 @@
+package crs
+
+// The projection formulas are those of Snyder, Map Projections: A Working
+// Manual (USGS Professional Paper 1395, 1987), for the ellipsoid. They reduce
+// to the spherical forms when the flattening is 0.
+
+import (
+	"fmt"
+	"math"
+)
+
+const deg = math.Pi / 180
+
+// projection converts between longitude/latitude in degrees and the
+// coordinates of a CRS
+type projection interface {
+	forward(lon, lat float64) (x, y float64)
+	inverse(x, y float64) (lon, lat float64)
+}
+
+// projection sets up the formulas of the CRS
+func (c *CRS) projection() (projection, error) {
+	if c.Kind != LongLat && (c.A <= 0 || c.ToMeter <= 0 || c.K0 <= 0) {
+		return nil, fmt.Errorf("%s: incomplete definition", c)
+	}
+	e := math.Sqrt(c.F * (2 - c.F))
+	switch c.Kind {
+	case LongLat:
+		return longLat{}, nil
+	case LCC:
+		return newLCC(c, e), nil
+	case Albers:
+		return newAlbers(c, e), nil
+	case Mercator:
+		return &mercator{crs: c, e: e, ak: c.A * c.K0}, nil
+	}
+	return nil, fmt.Errorf("unsupported projection %d", c.Kind)
+}
+
+type longLat struct{}
+
+func (longLat) forward(lon, lat float64) (float64, float64) { return lon, lat }
+func (longLat) inverse(x, y float64) (float64, float64)     { return x, y }
+
+// msfn is m = cos φ / √(1 - e² sin² φ)
+func msfn(e, phi float64) float64 {
+	s := e * math.Sin(phi)
+	return math.Cos(phi) / math.Sqrt(1-s*s)
+}
+
+// tsfn is t = tan(π/4 - φ/2) / ((1 - e sin φ) / (1 + e sin φ))^(e/2)
+func tsfn(e, phi float64) float64 {
+	s := e * math.Sin(phi)
+	return math.Tan(math.Pi/4-phi/2) / math.Pow((1-s)/(1+s), e/2)
+}
+
+// phi2 inverts tsfn by iteration
+func phi2(e, t float64) float64 {
+	phi := math.Pi/2 - 2*math.Atan(t)
+	for i := 0; i < 15; i++ {
+		s := e * math.Sin(phi)
+		next := math.Pi/2 - 2*math.Atan(t*math.Pow((1-s)/(1+s), e/2))
+		if math.Abs(next-phi) < 1e-12 {
+			return next
+		}
+		phi = next
+	}
+	return phi
+}
+
+// qsfn is q = (1 - e²) (sin φ / (1 - e² sin² φ) - ln((1 - e sin φ) / (1 + e sin φ)) / 2e)
+func qsfn(e, phi float64) float64 {
+	sin := math.Sin(phi)
+	if e < 1e-10 {
+		return 2 * sin
+	}
+	s := e * sin
+	return (1 - e*e) * (sin/(1-s*s) - math.Log((1-s)/(1+s))/(2*e))
+}
+
+// conic holds what LCC and Albers share: the cone constant n, the radius of
+// the origin ρ0 and the offsets of the projected coordinates
+type conic struct {
+	crs  *CRS
+	n    float64
+	rho0 float64
+}
+
+// toPlane converts the polar coordinates of a point on the cone to projected
+// coordinates
+func (k *conic) toPlane(rho, lon float64) (float64, float64) {
+	c := k.crs
+	theta := k.n * (lon - c.Lon0) * deg
+	x := rho*math.Sin(theta) + c.FalseEasting
+	y := k.rho0 - rho*math.Cos(theta) + c.FalseNorthing
+	return x / c.ToMeter, y / c.ToMeter
+}
+
+// fromPlane converts projected coordinates to the radius and longitude of
+// the point on the cone
+func (k *conic) fromPlane(x, y float64) (rho, lon float64) {
+	c := k.crs
+	x = x*c.ToMeter - c.FalseEasting
+	y = k.rho0 - (y*c.ToMeter - c.FalseNorthing)
+	sign := 1.0
+	if k.n < 0 {
+		sign = -1
+	}
+	rho = sign * math.Hypot(x, y)
+	theta := math.Atan2(sign*x, sign*y)
+	return rho, theta/k.n/deg + c.Lon0
+}
+
+type lcc struct {
+	conic
+	e, aF float64 // aF is a·F·k0
+}
+
+func newLCC(c *CRS, e float64) *lcc {
+	phi1, phi2 := c.Lat1*deg, c.Lat2*deg
+	m1, t1 := msfn(e, phi1), tsfn(e, phi1)
+	n := math.Sin(phi1)
+	if math.Abs(phi1-phi2) > 1e-10 {
+		n = (math.Log(m1) - math.Log(msfn(e, phi2))) / (math.Log(t1) - math.Log(tsfn(e, phi2)))
+	}
+	p := &lcc{conic: conic{crs: c, n: n}, e: e}
+	p.aF = c.A * c.K0 * m1 / (n * math.Pow(t1, n))
+	p.rho0 = p.rho(c.Lat0 * deg)
+	return p
+}
+
+func (p *lcc) rho(phi float64) float64 {
+	if math.Abs(math.Abs(phi)-math.Pi/2) < 1e-10 {
+		if phi*p.n > 0 {
+			return 0
+		}
+		return math.Inf(1)
+	}
+	return p.aF * math.Pow(tsfn(p.e, phi), p.n)
+}
+
+func (p *lcc) forward(lon, lat float64) (float64, float64) {
+	return p.toPlane(p.rho(lat*deg), lon)
+}
+
+func (p *lcc) inverse(x, y float64) (float64, float64) {
+	rho, lon := p.fromPlane(x, y)
+	if rho == 0 {
+		return lon, math.Copysign(90, p.n)
+	}
+	t := math.Pow(rho/p.aF, 1/p.n)
+	return lon, phi2(p.e, t) / deg
+}
+
+type albers struct {
+	conic
+	e, c float64
+}
+
+func newAlbers(c *CRS, e float64) *albers {
+	phi1, phi2 := c.Lat1*deg, c.Lat2*deg
+	m1, q1 := msfn(e, phi1), qsfn(e, phi1)
+	n := math.Sin(phi1)
+	if math.Abs(phi1-phi2) > 1e-10 {
+		m2 := msfn(e, phi2)
+		n = (m1*m1 - m2*m2) / (qsfn(e, phi2) - q1)
+	}
+	p := &albers{conic: conic{crs: c, n: n}, e: e, c: m1*m1 + n*q1}
+	p.rho0 = p.rho(c.Lat0 * deg)
+	return p
+}
+
+func (p *albers) rho(phi float64) float64 {
+	return p.crs.A * p.crs.K0 * math.Sqrt(math.Max(0, p.c-p.n*qsfn(p.e, phi))) / p.n
+}
+
+func (p *albers) forward(lon, lat float64) (float64, float64) {
+	return p.toPlane(p.rho(lat*deg), lon)
+}
+
+func (p *albers) inverse(x, y float64) (float64, float64) {
+	rho, lon := p.fromPlane(x, y)
+	ak := p.crs.A * p.crs.K0
+	q := (p.c - rho*rho*p.n*p.n/(ak*ak)) / p.n
+	q = math.Max(-2, math.Min(2, q))
+	phi := math.Asin(q / 2)
+	if p.e < 1e-10 {
+		return lon, phi / deg
+	}
+	// Snyder eq. 3-16
+	e2 := p.e * p.e
+	for i := 0; i < 15; i++ {
+		s := p.e * math.Sin(phi)
+		one := 1 - s*s
+		d := one * one / (2 * math.Cos(phi)) * (q/(1-e2) - math.Sin(phi)/one + math.Log((1-s)/(1+s))/(2*p.e))
+		phi += d
+		if math.Abs(d) < 1e-12 {
+			break
+		}
+	}
+	return lon, phi / deg
+}
+
+// mercatorMaxLat is the latitude Mercator coordinates are clipped to, as for
+// Web Mercator maps, since the poles are infinitely far away
+const mercatorMaxLat = 85.05112878
+
+type mercator struct {
+	crs *CRS
+	e   float64
+	ak  float64 // a·k0
+}
+
+func (p *mercator) forward(lon, lat float64) (float64, float64) {
+	c := p.crs
+	lat = math.Max(-mercatorMaxLat, math.Min(mercatorMaxLat, lat))
+	x := p.ak*(lon-c.Lon0)*deg + c.FalseEasting
+	y := -p.ak*math.Log(tsfn(p.e, lat*deg)) + c.FalseNorthing
+	return x / c.ToMeter, y / c.ToMeter
+}
+
+func (p *mercator) inverse(x, y float64) (float64, float64) {
+	c := p.crs
+	x = x*c.ToMeter - c.FalseEasting
+	y = y*c.ToMeter - c.FalseNorthing
+	return x/p.ak/deg + c.Lon0, phi2(p.e, math.Exp(-y/p.ak)) / deg
+}
@@ -0,0 +1,81 @@
+package crs
+
+import (
+	"math"
+	"testing"
+
+	"github.com/ctessum/geom"
+)
+
+// clarke1866 is the ellipsoid of Snyder's worked examples
+var clarke1866 = Ellipsoid{A: 6378206.4, F: 1 / 294.9786982}
+
+func TestProjectionsSnyder(t *testing.T) {
+	// Worked examples from Snyder, Map Projections: A Working Manual
+	// (USGS Professional Paper 1395, 1987), given to 0.1 m
+	for _, tc := range []struct {
+		name     string
+		crs      *CRS
+		lon, lat float64
+		x, y     float64
+		tol      float64
+	}{
+		{"LCC ellipsoid (p. 296)", &CRS{Kind: LCC, Ellipsoid: clarke1866, Lat0: 23, Lon0: -96, Lat1: 33, Lat2: 45, K0: 1, ToMeter: 1},
+			-75, 35, 1894410.9, 1564649.5, 0.1},
+		{"Albers ellipsoid (p. 292)", &CRS{Kind: Albers, Ellipsoid: clarke1866, Lat0: 23, Lon0: -96, Lat1: 29.5, Lat2: 45.5, K0: 1, ToMeter: 1},
+			-75, 35, 1885472.7, 1535925.0, 0.1},
+		{"Mercator sphere (p. 266)", &CRS{Kind: Mercator, Ellipsoid: Ellipsoid{A: 1}, Lon0: -180, K0: 1, ToMeter: 1},
+			-75, 35, 1.8325957, 0.6528366, 1e-7},
+	} {
+		geog := &CRS{Kind: LongLat, Ellipsoid: tc.crs.Ellipsoid}
+		fwd, err := Transform(geog, tc.crs)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		p := fwd(geom.Point{X: tc.lon, Y: tc.lat})
+		if math.Abs(p.X-tc.x) > tc.tol || math.Abs(p.Y-tc.y) > tc.tol {
+			t.Errorf("%s: (%g, %g) projects to (%.7f, %.7f), want (%g, %g)", tc.name, tc.lon, tc.lat, p.X, p.Y, tc.x, tc.y)
+		}
+		inv, err := Transform(tc.crs, geog)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		q := inv(p)
+		if math.Abs(q.X-tc.lon) > 1e-9 || math.Abs(q.Y-tc.lat) > 1e-9 {
+			t.Errorf("%s: inverse gives (%g, %g), want (%g, %g)", tc.name, q.X, q.Y, tc.lon, tc.lat)
+		}
+	}
+}
+
+func TestParseWKT(t *testing.T) {
+	// The .prj of an InMAP grid, as written by ESRI software
+	const inmap = `PROJCS["Lambert_Conformal_Conic",GEOGCS["GCS_unnamed ellipse",DATUM["D_unknown",SPHEROID["Unknown",6370997,0]],PRIMEM["Greenwich",0],UNIT["Degree",0.017453292519943295]],PROJECTION["Lambert_Conformal_Conic"],PARAMETER["standard_parallel_1",33],PARAMETER["standard_parallel_2",45],PARAMETER["latitude_of_origin",40],PARAMETER["central_meridian",-97],PARAMETER["false_easting",0],PARAMETER["false_northing",0],UNIT["Meter",1]]`
+	c, err := ParseWKT(inmap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &CRS{Kind: LCC, Ellipsoid: Ellipsoid{A: 6370997}, Lat0: 40, Lon0: -97, Lat1: 33, Lat2: 45, K0: 1, ToMeter: 1}
+	if !c.Equal(want) {
+		t.Errorf("parsed %+v, want %+v", c, want)
+	}
+
+	const albers = `PROJCS["NAD83 / Conus Albers",GEOGCS["NAD83",DATUM["North_American_Datum_1983",SPHEROID["GRS 1980",6378137,298.257222101]],PRIMEM["Greenwich",0],UNIT["degree",0.0174532925199433]],PROJECTION["Albers_Conic_Equal_Area"],PARAMETER["standard_parallel_1",29.5],PARAMETER["standard_parallel_2",45.5],PARAMETER["latitude_of_center",23],PARAMETER["longitude_of_center",-96],PARAMETER["false_easting",0],PARAMETER["false_northing",0],UNIT["metre",1],AUTHORITY["EPSG","5070"]]`
+	c, err = ParseWKT(albers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	epsg, _ := FromEPSG(5070)
+	if !c.Equal(epsg) {
+		t.Errorf("parsed %+v, want EPSG:5070 %+v", c, epsg)
+	}
+
+	for _, bad := range []string{
+		`GEOGCRS["WGS 84",DATUM["World Geodetic System 1984",ELLIPSOID["WGS 84",6378137,298.257223563]]]`,
+		`PROJCS["x",GEOGCS["g",DATUM["d",SPHEROID["s",6378137,298.257223563]],PRIMEM["Greenwich",0],UNIT["degree",0.0174532925199433]],PROJECTION["Transverse_Mercator"],UNIT["metre",1]]`,
+		`GEOGCS["g",DATUM["d",SPHEROID["s",6378137,298.257223563]],PRIMEM["Paris",2.33722917],UNIT["degree",0.0174532925199433]]`,
+	} {
+		if _, err := ParseWKT(bad); err == nil {
+			t.Errorf("ParseWKT(%.40s...) succeeded, want an error", bad)
+		}
+	}
+}
@@ -0,0 +1,340 @@
+package crs
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// node is a WKT keyword and its arguments, which are strings, numbers and
+// nodes
+type node struct {
+	keyword string
+	args    []interface{}
+}
+
+// child returns the first argument that is a node with one of the keywords
+func (n *node) child(keywords ...string) *node {
+	if n == nil {
+		return nil
+	}
+	for _, a := range n.args {
+		if c, ok := a.(*node); ok {
+			for _, k := range keywords {
+				if strings.EqualFold(c.keyword, k) {
+					return c
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// str returns argument i as a string, or "" if it is not one
+func (n *node) str(i int) string {
+	if n == nil || i >= len(n.args) {
+		return ""
+	}
+	s, _ := n.args[i].(string)
+	return s
+}
+
+// num returns argument i as a number
+func (n *node) num(i int) (float64, bool) {
+	if n == nil || i >= len(n.args) {
+		return 0, false
+	}
+	v, ok := n.args[i].(float64)
+	return v, ok
+}
+
+// wktParser reads WKT such as PROJCS["name",GEOGCS[...],PARAMETER["x",1]]
+type wktParser struct {
+	s   string
+	pos int
+}
+
+func (p *wktParser) skipSpace() {
+	for p.pos < len(p.s) && strings.ContainsRune(" \t\r\n", rune(p.s[p.pos])) {
+		p.pos++
+	}
+}
+
+func (p *wktParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("invalid WKT at character %d: %s", p.pos+1, fmt.Sprintf(format, args...))
+}
+
+// node reads a keyword and its bracketed arguments
+func (p *wktParser) node() (*node, error) {
+	p.skipSpace()
+	start := p.pos
+	for p.pos < len(p.s) && (isLetter(p.s[p.pos]) || p.s[p.pos] == '_' || (p.pos > start && isDigit(p.s[p.pos]))) {
+		p.pos++
+	}
+	if p.pos == start {
+		return nil, p.errorf("expected a keyword")
+	}
+	n := &node{keyword: p.s[start:p.pos]}
+	p.skipSpace()
+	if p.pos >= len(p.s) || (p.s[p.pos] != '[' && p.s[p.pos] != '(') {
+		// A bare word such as EAST in AXIS["x",EAST]
+		return n, nil
+	}
+	closer := byte(']')
+	if p.s[p.pos] == '(' {
+		closer = ')'
+	}
+	p.pos++
+	for {
+		p.skipSpace()
+		if p.pos >= len(p.s) {
+			return nil, p.errorf("unclosed %s", n.keyword)
+		}
+		switch c := p.s[p.pos]; {
+		case c == '"':
+			s, err := p.quoted()
+			if err != nil {
+				return nil, err
+			}
+			n.args = append(n.args, s)
+		case isDigit(c) || c == '-' || c == '+' || c == '.':
+			start := p.pos
+			for p.pos < len(p.s) && strings.ContainsRune("0123456789+-.eE", rune(p.s[p.pos])) {
+				p.pos++
+			}
+			v, err := strconv.ParseFloat(p.s[start:p.pos], 64)
+			if err != nil {
+				return nil, p.errorf("bad number %q", p.s[start:p.pos])
+			}
+			n.args = append(n.args, v)
+		default:
+			c, err := p.node()
+			if err != nil {
+				return nil, err
+			}
+			if c.args == nil {
+				n.args = append(n.args, c.keyword)
+			} else {
+				n.args = append(n.args, c)
+			}
+		}
+		p.skipSpace()
+		if p.pos >= len(p.s) {
+			return nil, p.errorf("unclosed %s", n.keyword)
+		}
+		switch p.s[p.pos] {
+		case ',':
+			p.pos++
+		case closer:
+			p.pos++
+			if n.args == nil {
+				n.args = []interface{}{}
+			}
+			return n, nil
+		default:
+			return nil, p.errorf("unexpected %q in %s", p.s[p.pos], n.keyword)
+		}
+	}
+}
+
+// quoted reads a quoted string, in which "" stands for "
+func (p *wktParser) quoted() (string, error) {
+	var b strings.Builder
+	p.pos++
+	for p.pos < len(p.s) {
+		c := p.s[p.pos]
+		p.pos++
+		if c != '"' {
+			b.WriteByte(c)
+			continue
+		}
+		if p.pos < len(p.s) && p.s[p.pos] == '"' {
+			b.WriteByte('"')
+			p.pos++
+			continue
+		}
+		return b.String(), nil
+	}
+	return "", p.errorf("unterminated string")
+}
+
+func isLetter(c byte) bool { return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' }
+func isDigit(c byte) bool  { return c >= '0' && c <= '9' }
+
+// normalize lowercases a WKT name and drops everything but letters and
+// digits, so that "Lambert_Conformal_Conic_2SP" and "Lambert Conformal Conic
+// (2SP)" compare equal
+func normalize(s string) string {
+	var b strings.Builder
+	for _, c := range strings.ToLower(s) {
+		if c >= 'a' && c <= 'z' || c >= '0' && c <= '9' {
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+// webMercatorCodes are the EPSG and ESRI codes of Web Mercator
+var webMercatorCodes = map[string]bool{"3857": true, "900913": true, "3785": true, "102100": true, "102113": true}
+
+// ParseWKT reads a CRS from OGC or ESRI WKT (version 1), as in shapefile
+// .prj files. Projections other than those of the Kind constants, prime
+// meridians other than Greenwich, angular units other than degrees and WKT
+// version 2 are errors.
+func ParseWKT(wkt string) (*CRS, error) {
+	p := &wktParser{s: strings.TrimSpace(wkt)}
+	root, err := p.node()
+	if err != nil {
+		return nil, err
+	}
+	if p.skipSpace(); p.pos != len(p.s) {
+		return nil, p.errorf("unexpected text after %s", root.keyword)
+	}
+	var c *CRS
+	switch strings.ToUpper(root.keyword) {
+	case "GEOGCS":
+		c, err = geographic(root)
+	case "PROJCS":
+		c, err = projected(root)
+	case "GEOGCRS", "GEODCRS", "PROJCRS", "BOUNDCRS", "COMPOUNDCRS":
+		return nil, fmt.Errorf("%s: WKT version 2 is not supported; save the file with WKT version 1 (ESRI .prj) instead", root.keyword)
+	default:
+		return nil, fmt.Errorf("unsupported coordinate system type %s", root.keyword)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s %q: %v", root.keyword, root.str(0), err)
+	}
+	c.WKT = wkt
+	return c, nil
+}
+
+// geographic reads a GEOGCS node
+func geographic(n *node) (*CRS, error) {
+	c := &CRS{Name: n.str(0), Kind: LongLat}
+	sph := n.child("DATUM").child("SPHEROID", "ELLIPSOID")
+	if sph == nil {
+		return nil, errors.New("no SPHEROID")
+	}
+	a, ok := sph.num(1)
+	invf, ok2 := sph.num(2)
+	if !ok || !ok2 || a <= 0 {
+		return nil, fmt.Errorf("SPHEROID %q needs a semi-major axis and inverse flattening", sph.str(0))
+	}
+	c.A = a
+	if invf != 0 {
+		c.F = 1 / invf
+	}
+	if pm, ok := n.child("PRIMEM").num(1); ok && pm != 0 {
+		return nil, fmt.Errorf("unsupported prime meridian %g", pm)
+	}
+	if u, ok := n.child("UNIT").num(1); ok && math.Abs(u-deg) > 1e-9 {
+		return nil, fmt.Errorf("unsupported angular unit %q", n.child("UNIT").str(0))
+	}
+	return c, nil
+}
+
+// projected reads a PROJCS node
+func projected(n *node) (*CRS, error) {
+	geog := n.child("GEOGCS")
+	if geog == nil {
+		return nil, errors.New("no GEOGCS")
+	}
+	c, err := geographic(geog)
+	if err != nil {
+		return nil, err
+	}
+	c.Name = n.str(0)
+	c.K0 = 1
+	c.ToMeter = 1
+	if u, ok := n.child("UNIT").num(1); ok {
+		if u <= 0 {
+			return nil, fmt.Errorf("invalid linear unit %g", u)
+		}
+		c.ToMeter = u
+	}
+
+	params := make(map[string]float64)
+	for _, a := range n.args {
+		if p, ok := a.(*node); ok && strings.EqualFold(p.keyword, "PARAMETER") {
+			if v, ok := p.num(1); ok {
+				params[normalize(p.str(0))] = v
+			}
+		}
+	}
+	param := func(names ...string) (float64, bool) {
+		for _, name := range names {
+			if v, ok := params[name]; ok {
+				return v, true
+			}
+		}
+		return 0, false
+	}
+	c.FalseEasting, _ = param("falseeasting")
+	c.FalseNorthing, _ = param("falsenorthing")
+	// False easting and northing are in the linear unit
+	c.FalseEasting *= c.ToMeter
+	c.FalseNorthing *= c.ToMeter
+	if k, ok := param("scalefactor", "scalefactoratnaturalorigin"); ok {
+		c.K0 = k
+	}
+
+	name := n.child("PROJECTION").str(0)
+	switch normalize(name) {
+	case "lambertconformalconic", "lambertconformalconic2sp", "lambertconformalconic1sp":
+		c.Kind = LCC
+		c.Lat0, _ = param("latitudeoforigin")
+		c.Lon0, _ = param("centralmeridian", "longitudeoforigin")
+		var ok bool
+		if c.Lat1, ok = param("standardparallel1"); !ok {
+			// One standard parallel at the origin, with a scale factor
+			c.Lat1 = c.Lat0
+		}
+		if c.Lat2, ok = param("standardparallel2"); !ok {
+			c.Lat2 = c.Lat1
+		}
+		if c.Lat1 == 0 && c.Lat2 == 0 {
+			return nil, errors.New("Lambert conformal conic with a standard parallel on the equator")
+		}
+	case "albersconicequalarea", "albers", "albersequalarea":
+		c.Kind = Albers
+		c.Lat0, _ = param("latitudeofcenter", "latitudeoforigin")
+		c.Lon0, _ = param("longitudeofcenter", "centralmeridian")
+		var ok, ok2 bool
+		c.Lat1, ok = param("standardparallel1")
+		c.Lat2, ok2 = param("standardparallel2")
+		if !ok || !ok2 {
+			return nil, errors.New("Albers projection needs standard_parallel_1 and standard_parallel_2")
+		}
+		if c.Lat1 == -c.Lat2 {
+			return nil, errors.New("Albers projection with standard parallels symmetric about the equator")
+		}
+	case "mercatorauxiliarysphere", "popularvisualisationpseudomercator":
+		if t, _ := param("auxiliaryspheretype"); t != 0 {
+			return nil, fmt.Errorf("unsupported Auxiliary_Sphere_Type %g", t)
+		}
+		c.Kind = Mercator
+		c.F = 0
+		c.Lon0, _ = param("centralmeridian")
+	case "mercator", "mercator1sp", "mercator2sp":
+		c.Kind = Mercator
+		c.Lon0, _ = param("centralmeridian", "longitudeoforigin")
+		auth := n.child("AUTHORITY")
+		proj4 := strings.Replace(n.child("EXTENSION").str(1), " ", "", -1)
+		if strings.EqualFold(auth.str(0), "EPSG") && webMercatorCodes[auth.str(1)] ||
+			strings.Contains(proj4, fmt.Sprintf("+b=%g", c.A)) || strings.Contains(strings.ToLower(c.Name), "pseudo-mercator") {
+			// Web Mercator treats latitudes as if on a sphere
+			c.F = 0
+		}
+		if lat1, ok := param("standardparallel1"); ok {
+			c.Lat1 = lat1
+			c.K0 = msfn(math.Sqrt(c.F*(2-c.F)), lat1*deg)
+		}
+	case "":
+		return nil, errors.New("no PROJECTION")
+	default:
+		return nil, fmt.Errorf("unsupported projection %q; supported are Lambert conformal conic, Albers equal-area conic and Mercator", name)
+	}
+	return c, nil
+}
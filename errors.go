@@ -0,0 +1,106 @@
+package main
+
+// Errors are returned up to main, which reports them with an exit status and,
+// if -errorSummary is given, a JSON summary that batch runs can collect
+// instead of parsing the log.
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"mortality/ioformats"
+)
+
+// Exit statuses
+const (
+	exitOK          = 0
+	exitError       = 1 // An input could not be read or an output written
+	exitConfigError = 2 // Invalid configuration, flags or subcommand
+)
+
+const errorSummaryUsage = "Path of a JSON file to write the outcome of the run to, with the file, row and field of any error"
+
+// configError is an invalid setting in the configuration file or on the
+// command line. field names the setting, if there is one.
+type configError struct {
+	field string
+	err   error
+}
+
+func (e configError) Error() string { return e.err.Error() }
+
+func (e configError) Unwrap() error { return e.err }
+
+// configErrorf returns a configError for the setting field
+func configErrorf(field, format string, a ...interface{}) error {
+	return configError{field: field, err: fmt.Errorf(format, a...)}
+}
+
+// runSummary is the machine-readable outcome of a command written to the
+// -errorSummary file
+type runSummary struct {
+	Status   string `json:"status"` // "ok" or "error"
+	Command  string `json:"command"`
+	ExitCode int    `json:"exitCode"`
+	Message  string `json:"message,omitempty"`
+	File     string `json:"file,omitempty"`
+	Row      int    `json:"row,omitempty"`
+	Field    string `json:"field,omitempty"`
+}
+
+// newRunSummary describes the outcome of cmd, taking the file, row and field
+// from err where it has them
+func newRunSummary(cmd string, err error) runSummary {
+	s := runSummary{Status: "ok", Command: cmd, ExitCode: exitOK}
+	if err == nil {
+		return s
+	}
+	s.Status = "error"
+	s.ExitCode = exitError
+	s.Message = err.Error()
+
+	var ce configError
+	if errors.As(err, &ce) {
+		s.ExitCode = exitConfigError
+		if ce.field != "" {
+			s.File, s.Field = *configFile, ce.field
+		}
+	}
+	var fe *ioformats.FileError
+	var pe *os.PathError
+	if errors.As(err, &fe) {
+		s.File, s.Row, s.Field = fe.File, fe.Row, fe.Field
+	} else if errors.As(err, &pe) {
+		s.File = pe.Path
+	}
+	return s
+}
+
+// exitStatus reports the outcome of cmd on stderr and in the -errorSummary
+// file, if one was given, and returns the exit status
+func exitStatus(cmd string, err error) int {
+	if errors.Is(err, flag.ErrHelp) {
+		return exitOK
+	}
+	s := newRunSummary(cmd, err)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+	}
+	if *errorSummary != "" {
+		b, jerr := json.MarshalIndent(s, "", "  ")
+		if jerr == nil {
+			jerr = ioutil.WriteFile(*errorSummary, append(b, '\n'), 0644)
+		}
+		if jerr != nil {
+			fmt.Fprintf(os.Stderr, "Error: writing %s: %v\n", *errorSummary, jerr)
+			if s.ExitCode == exitOK {
+				return exitError
+			}
+		}
+	}
+	return s.ExitCode
+}
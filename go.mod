@@ -3,7 +3,8 @@ module mortality
 go 1.15
 
 require (
-	github.com/ctessum/geom v0.2.11 // indirect
-	github.com/fhs/go-netcdf v1.2.1 // indirect
-	github.com/mattn/go-sqlite3 v1.14.32 // indirect
+	github.com/ctessum/geom v0.2.11
+	github.com/fhs/go-netcdf v1.2.1
+	github.com/jonas-p/go-shp v0.1.2-0.20190401125246-9fd306ae10a6
+	github.com/mattn/go-sqlite3 v1.14.32
 )
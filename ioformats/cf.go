@@ -0,0 +1,200 @@
+package ioformats
+
+// The CF conventions (https://cfconventions.org) say how a NetCDF variable's
+// dimensions are identified as longitude, latitude, vertical and time, where
+// its cell boundaries are, and how its stored values are packed. The
+// functions here apply them to values already read from a file.
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// cfAxis classifies a coordinate variable as 'X' (longitude), 'Y'
+// (latitude), 'Z' (vertical) or 'T' (time) from its attributes, in the
+// order CF gives them: axis, standard_name, units and positive. Common names
+// such as "lat" and "lev" are used when none of these settle it. It returns
+// 0 for anything else.
+func cfAxis(name string, attr func(string) string) byte {
+	switch a := strings.ToUpper(strings.TrimSpace(attr("axis"))); a {
+	case "X", "Y", "Z", "T":
+		return a[0]
+	}
+	switch sn := strings.ToLower(attr("standard_name")); {
+	case sn == "longitude" || sn == "grid_longitude":
+		return 'X'
+	case sn == "latitude" || sn == "grid_latitude":
+		return 'Y'
+	case sn == "time":
+		return 'T'
+	case sn == "air_pressure" || sn == "altitude" || sn == "height" || sn == "depth" ||
+		sn == "model_level_number" || strings.HasPrefix(sn, "atmosphere_") && strings.HasSuffix(sn, "_coordinate"):
+		return 'Z'
+	}
+	switch u := normalizeUnits(attr("units")); {
+	case u == "degrees_east" || u == "degree_east" || u == "degrees_e" || u == "degree_e" || u == "degreese" || u == "degreee":
+		return 'X'
+	case u == "degrees_north" || u == "degree_north" || u == "degrees_n" || u == "degree_n" || u == "degreesn" || u == "degreen":
+		return 'Y'
+	case strings.Contains(u, " since "):
+		return 'T'
+	case isPressure(u):
+		return 'Z'
+	}
+	if p := strings.ToLower(attr("positive")); p == "up" || p == "down" {
+		return 'Z'
+	}
+	switch strings.ToLower(name) {
+	case "lon", "longitude", "long", "nav_lon":
+		return 'X'
+	case "lat", "latitude", "nav_lat":
+		return 'Y'
+	case "lev", "level", "levels", "ilev", "plev", "height", "altitude", "z":
+		return 'Z'
+	case "time", "t":
+		return 'T'
+	}
+	return 0
+}
+
+// normalizeUnits lowercases units and trims them
+func normalizeUnits(u string) string {
+	return strings.ToLower(strings.TrimSpace(u))
+}
+
+// isPressure reports whether units are those of pressure
+func isPressure(u string) bool {
+	switch u {
+	case "pa", "hpa", "kpa", "mb", "mbar", "millibar", "millibars", "bar", "atm":
+		return true
+	}
+	return false
+}
+
+// surfaceLast reports whether the last level of a vertical coordinate,
+// rather than the first, is nearest the ground. That is so for pressure
+// levels that increase along the dimension. Other vertical coordinates are
+// taken to start at the ground, as in GEOS-Chem output, whose hybrid levels
+// decrease upwards despite being marked positive "up".
+func surfaceLast(values []float64, units string) bool {
+	n := len(values)
+	return isPressure(normalizeUnits(units)) && n > 1 && values[n-1] > values[0]
+}
+
+// cellBounds returns the lower and upper bound of each cell along a
+// coordinate, from its CF bounds variable (pairs of values) if it has one, or
+// halfway between neighbouring centres otherwise, so that irregular spacing
+// is kept. The centres must be strictly increasing or decreasing. Latitudes
+// are clipped to ±90°.
+func cellBounds(centres, bnds []float64, lat bool) ([][2]float64, error) {
+	n := len(centres)
+	if n == 0 {
+		return nil, fmt.Errorf("no values")
+	}
+	for i, c := range centres {
+		if math.IsNaN(c) || math.IsInf(c, 0) {
+			return nil, fmt.Errorf("value %d is %g", i, c)
+		}
+		if i == 0 {
+			continue
+		}
+		if d := c - centres[i-1]; d == 0 || (d > 0) != (centres[1] > centres[0]) {
+			return nil, fmt.Errorf("values are not strictly increasing or decreasing at index %d (%g after %g)", i, c, centres[i-1])
+		}
+	}
+	b := make([][2]float64, n)
+	switch {
+	case bnds != nil:
+		if len(bnds) != 2*n {
+			return nil, fmt.Errorf("bounds have %d values for %d cells; expected 2 per cell", len(bnds), n)
+		}
+		for i := range b {
+			b[i] = [2]float64{math.Min(bnds[2*i], bnds[2*i+1]), math.Max(bnds[2*i], bnds[2*i+1])}
+		}
+	case n == 1:
+		return nil, fmt.Errorf("a single value (%g) needs a bounds variable to give the cell size", centres[0])
+	default:
+		edges := CellEdges(centres)
+		for i := range b {
+			b[i] = [2]float64{math.Min(edges[i], edges[i+1]), math.Max(edges[i], edges[i+1])}
+		}
+	}
+	if lat {
+		for i := range b {
+			b[i][0] = math.Max(-90, math.Min(90, b[i][0]))
+			b[i][1] = math.Max(-90, math.Min(90, b[i][1]))
+		}
+	}
+	return b, nil
+}
+
+// wrapLongitudes moves longitudes, and their cell bounds, by whole turns to
+// -180 to 180°, so that grids from 0 to 360° land on the same cells as
+// grids from -180 to 180°. The cells are then put back in order of longitude,
+// in the direction they were in. order gives the original index of each
+// cell, or is nil if no longitude needed moving, in which case centres and
+// bounds are returned as they are.
+func wrapLongitudes(centres []float64, bounds [][2]float64) (wrapped []float64, wrappedBounds [][2]float64, order []int) {
+	shift := make([]float64, len(centres))
+	moved := false
+	for i, c := range centres {
+		shift[i] = -360 * math.Floor((c+180)/360)
+		moved = moved || shift[i] != 0
+	}
+	if !moved {
+		return centres, bounds, nil
+	}
+	order = make([]int, len(centres))
+	for i := range order {
+		order[i] = i
+	}
+	increasing := len(centres) < 2 || centres[1] > centres[0]
+	sort.SliceStable(order, func(a, b int) bool {
+		ca, cb := centres[order[a]]+shift[order[a]], centres[order[b]]+shift[order[b]]
+		if increasing {
+			return ca < cb
+		}
+		return ca > cb
+	})
+	wrapped = make([]float64, len(centres))
+	wrappedBounds = make([][2]float64, len(bounds))
+	for i, o := range order {
+		wrapped[i] = centres[o] + shift[o]
+		wrappedBounds[i] = [2]float64{bounds[o][0] + shift[o], bounds[o][1] + shift[o]}
+	}
+	return wrapped, wrappedBounds, order
+}
+
+// packing is how the stored values of a variable map to data values: values
+// equal to a fill value, NaN or outside the valid range are missing, and the
+// rest are multiplied by scale and added to offset
+type packing struct {
+	scale, offset      float64
+	fill               []float64
+	validMin, validMax float64
+}
+
+// apply converts stored values to data values in place, setting missing
+// values to NaN, and returns the number of missing values
+func (p packing) apply(data []float64) int {
+	missing := 0
+	for i, v := range data {
+		bad := math.IsNaN(v) || v < p.validMin || v > p.validMax
+		for _, f := range p.fill {
+			if v == f || math.Abs(f) > 1e30 && math.Abs(v-f) <= 1e-6*math.Abs(f) {
+				// Compare large float fill values with some slack, since
+				// they may have passed through single precision
+				bad = true
+			}
+		}
+		if bad {
+			data[i] = math.NaN()
+			missing++
+			continue
+		}
+		data[i] = v*p.scale + p.offset
+	}
+	return missing
+}
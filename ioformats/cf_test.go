@@ -0,0 +1,99 @@
+package ioformats
+
+import (
+	"math"
+	"testing"
+)
+
+func TestPackingApply(t *testing.T) {
+	inf := math.Inf(1)
+	nan := math.NaN()
+	for _, tc := range []struct {
+		name    string
+		p       packing
+		in      []float64
+		want    []float64 // NaN where missing
+		missing int
+	}{
+		{"unpacked", packing{scale: 1, validMin: -inf, validMax: inf},
+			[]float64{0, 1.5, -2}, []float64{0, 1.5, -2}, 0},
+		{"scale_factor and add_offset", packing{scale: 0.01, offset: 273.15, validMin: -inf, validMax: inf},
+			[]float64{0, 100, -32767}, []float64{273.15, 274.15, 273.15 - 327.67}, 0},
+		{"_FillValue is compared before unpacking", packing{scale: 0.5, offset: 10, fill: []float64{-32767}, validMin: -inf, validMax: inf},
+			[]float64{-32767, 4, nan}, []float64{nan, 12, nan}, 2},
+		{"_FillValue and missing_value", packing{scale: 1, fill: []float64{-999, -1}, validMin: -inf, validMax: inf},
+			[]float64{-999, -1, 3}, []float64{nan, nan, 3}, 2},
+		{"default double fill through single precision", packing{scale: 1, fill: []float64{9.9692099683868690e+36}, validMin: -inf, validMax: inf},
+			[]float64{float64(float32(9.9692099683868690e+36)), 1e30}, []float64{nan, 1e30}, 1},
+		{"valid_range on packed values", packing{scale: 2, validMin: 0, validMax: 100},
+			[]float64{-1, 0, 100, 101}, []float64{nan, 0, 200, nan}, 2},
+	} {
+		data := append([]float64(nil), tc.in...)
+		missing := tc.p.apply(data)
+		if missing != tc.missing {
+			t.Errorf("%s: %d missing values, want %d", tc.name, missing, tc.missing)
+		}
+		for i := range data {
+			if math.IsNaN(tc.want[i]) != math.IsNaN(data[i]) || !math.IsNaN(data[i]) && math.Abs(data[i]-tc.want[i]) > 1e-9 {
+				t.Errorf("%s: %g unpacks to %g, want %g", tc.name, tc.in[i], data[i], tc.want[i])
+			}
+		}
+	}
+}
+
+func TestWrapLongitudes(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		centres []float64
+		want    []float64
+		order   []int
+	}{
+		{"already -180 to 180", []float64{-135, -45, 45, 135}, []float64{-135, -45, 45, 135}, nil},
+		{"0 to 360", []float64{45, 135, 225, 315}, []float64{-135, -45, 45, 135}, []int{2, 3, 0, 1}},
+		{"0 to 360 decreasing", []float64{315, 225, 135, 45}, []float64{135, 45, -45, -135}, []int{2, 3, 0, 1}},
+	} {
+		bounds := make([][2]float64, len(tc.centres))
+		for i, c := range tc.centres {
+			bounds[i] = [2]float64{c - 45, c + 45}
+		}
+		wrapped, wrappedBounds, order := wrapLongitudes(tc.centres, bounds)
+		if (order == nil) != (tc.order == nil) {
+			t.Fatalf("%s: order %v, want %v", tc.name, order, tc.order)
+		}
+		for i := range tc.want {
+			if wrapped[i] != tc.want[i] || wrappedBounds[i] != [2]float64{tc.want[i] - 45, tc.want[i] + 45} {
+				t.Errorf("%s: cell %d is %g %v, want %g", tc.name, i, wrapped[i], wrappedBounds[i], tc.want[i])
+			}
+			if order != nil && order[i] != tc.order[i] {
+				t.Errorf("%s: order %v, want %v", tc.name, order, tc.order)
+				break
+			}
+		}
+	}
+}
+
+func TestCellBounds(t *testing.T) {
+	b, err := cellBounds([]float64{-89, 0, 89}, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][2]float64{{-90, -44.5}, {-44.5, 44.5}, {44.5, 90}}
+	for i := range want {
+		if b[i] != want[i] {
+			t.Errorf("latitude bounds %v, want %v", b, want)
+			break
+		}
+	}
+	b, err = cellBounds([]float64{10, 0}, []float64{15, 5, 5, -5}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b[0] != [2]float64{5, 15} || b[1] != [2]float64{-5, 5} {
+		t.Errorf("bounds from a bounds variable %v", b)
+	}
+	for _, bad := range [][]float64{{0, 1, 1}, {0, 2, 1}, {0, math.NaN()}, {5}} {
+		if _, err := cellBounds(bad, nil, false); err == nil {
+			t.Errorf("cellBounds(%v) succeeded, want an error", bad)
+		}
+	}
+}
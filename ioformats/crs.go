@@ -0,0 +1,97 @@
+package ioformats
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"mortality/crs"
+)
+
+// ReadCRS returns the coordinate reference system of a shapefile, GeoPackage
+// or NetCDF file, chosen by its extension. NetCDF files are always in
+// longitude/latitude. The CRS is nil if the file does not record one.
+func ReadCRS(file string) (*crs.CRS, error) {
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".nc":
+		return crs.WGS84, nil
+	case ".gpkg":
+		return GeoPackageCRS(file)
+	}
+	return ShapefileCRS(file)
+}
+
+// ShapefileCRS reads the CRS of a shapefile from its .prj file. It returns
+// nil if there is no .prj file, and an error if the file cannot be read or
+// describes an unsupported CRS.
+func ShapefileCRS(shpFile string) (*crs.CRS, error) {
+	prjFile := strings.TrimSuffix(shpFile, filepath.Ext(shpFile)) + ".prj"
+	b, err := ioutil.ReadFile(prjFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, &FileError{File: prjFile, Err: err}
+	}
+	c, err := crs.ParseWKT(string(b))
+	if err != nil {
+		return nil, &FileError{File: prjFile, Err: err}
+	}
+	return c, nil
+}
+
+// WritePrj writes the .prj file of a shapefile in the CRS c. Nothing is
+// written if c is nil or was not read from WKT.
+func WritePrj(shpFile string, c *crs.CRS) error {
+	if c == nil || c.WKT == "" {
+		return nil
+	}
+	prjFile := strings.TrimSuffix(shpFile, filepath.Ext(shpFile)) + ".prj"
+	if err := ioutil.WriteFile(prjFile, []byte(c.WKT), 0644); err != nil {
+		return &FileError{File: prjFile, Err: err}
+	}
+	return nil
+}
+
+// GeoPackageCRS reads the CRS of the geometry column of the first feature
+// table of a GeoPackage, from its srs_id. EPSG codes known to crs.FromEPSG
+// are used directly and other systems are read from their WKT definition.
+// The "undefined geographic" srs_id 0 is taken to be WGS 84, and the
+// "undefined cartesian" srs_id -1 gives a nil CRS.
+func GeoPackageCRS(gpkgFile string) (*crs.CRS, error) {
+	db, table, _, err := gpkgFeatureTable(gpkgFile)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	var srsID, code int
+	var org, definition string
+	err = db.QueryRow(`SELECT s.srs_id, s.organization, s.organization_coordsys_id, s.definition
+		FROM gpkg_geometry_columns g JOIN gpkg_spatial_ref_sys s ON g.srs_id = s.srs_id
+		WHERE g.table_name = ?`, table).Scan(&srsID, &org, &code, &definition)
+	if err != nil {
+		return nil, &FileError{File: gpkgFile, Err: fmt.Errorf("finding the spatial reference system of %s: %v", table, err)}
+	}
+	switch srsID {
+	case 0:
+		return crs.WGS84, nil
+	case -1:
+		return nil, nil
+	}
+	if strings.EqualFold(org, "EPSG") || strings.EqualFold(org, "ESRI") {
+		if c, err := crs.FromEPSG(code); err == nil {
+			known := *c
+			if definition != "undefined" {
+				known.WKT = definition
+			}
+			return &known, nil
+		}
+	}
+	c, err := crs.ParseWKT(definition)
+	if err != nil {
+		return nil, &FileError{File: gpkgFile, Err: fmt.Errorf("srs_id %d (%s:%d): %v", srsID, org, code, err)}
+	}
+	return c, nil
+}
@@ -0,0 +1,25 @@
+package ioformats
+
+import (
+	"encoding/csv"
+	"errors"
+	"os"
+)
+
+// ReadCSV reads all records from a CSV file
+func ReadCSV(filename string) ([][]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	data, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		var pe *csv.ParseError
+		if errors.As(err, &pe) {
+			return nil, &FileError{File: filename, Row: pe.Line, Err: pe.Err}
+		}
+		return nil, &FileError{File: filename, Err: err}
+	}
+	return data, nil
+}
@@ -0,0 +1,33 @@
+package ioformats
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// FileError is an error reading or writing a file, with the row and field
+// where it occurred when they are known
+type FileError struct {
+	File  string
+	Row   int    // 1-based; 0 if the error is not in a particular row
+	Field string // Attribute, column or variable; "" if not known
+	Err   error
+}
+
+func (e *FileError) Error() string {
+	var pe *os.PathError
+	if e.Row == 0 && e.Field == "" && errors.As(e.Err, &pe) && pe.Path == e.File {
+		return e.Err.Error() // Already names the file
+	}
+	s := e.File
+	if e.Row > 0 {
+		s += fmt.Sprintf(", row %d", e.Row)
+	}
+	if e.Field != "" {
+		s += ", field " + e.Field
+	}
+	return s + ": " + e.Err.Error()
+}
+
+func (e *FileError) Unwrap() error { return e.Err }
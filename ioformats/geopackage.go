@@ -0,0 +1,368 @@
+package ioformats
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+
+	"github.com/ctessum/geom"
+	"github.com/ctessum/geom/encoding/wkb"
+	_ "github.com/mattn/go-sqlite3" // GeoPackages are SQLite databases
+)
+
+// GpkgSRS is the spatial reference system of GeoPackage outputs. Cells must
+// be in longitude/latitude (crs.WGS84), as for NetCDF outputs.
+const GpkgSRS = 4326
+
+// FeatureTable is a GeoPackage feature table of polygons with one REAL column
+// per field and, if Names is not nil, a name column
+type FeatureTable struct {
+	Name        string
+	Description string
+	Shapes      []geom.Polygonal
+	Names       []string
+	Fields      []Field
+}
+
+// WriteGeoPackage writes a GeoPackage with the given feature tables and, if
+// metadata is not empty, a "run_metadata" attribute table of key/value
+// pairs. An existing file is replaced.
+func WriteGeoPackage(filename string, tables []FeatureTable, metadata [][2]string) error {
+	if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	db, err := sql.Open("sqlite3", filename)
+	if err != nil {
+		return &FileError{File: filename, Err: err}
+	}
+	defer db.Close()
+	// "GPKG" application id and version 1.2
+	if _, err := db.Exec("PRAGMA application_id = 1196444487; PRAGMA user_version = 10200"); err != nil {
+		return &FileError{File: filename, Err: err}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return &FileError{File: filename, Err: err}
+	}
+	if err := writeGpkgTables(tx, tables, metadata); err != nil {
+		tx.Rollback()
+		return &FileError{File: filename, Err: err}
+	}
+	if err := tx.Commit(); err != nil {
+		return &FileError{File: filename, Err: err}
+	}
+	return nil
+}
+
+func writeGpkgTables(tx *sql.Tx, tables []FeatureTable, metadata [][2]string) error {
+	for _, query := range []string{
+		`CREATE TABLE gpkg_spatial_ref_sys (
+		srs_name TEXT NOT NULL, srs_id INTEGER NOT NULL PRIMARY KEY, organization TEXT NOT NULL,
+		organization_coordsys_id INTEGER NOT NULL, definition TEXT NOT NULL, description TEXT)`,
+		`INSERT INTO gpkg_spatial_ref_sys VALUES
+		('Undefined cartesian SRS', -1, 'NONE', -1, 'undefined', 'undefined cartesian coordinate reference system'),
+		('Undefined geographic SRS', 0, 'NONE', 0, 'undefined', 'undefined geographic coordinate reference system'),
+		('WGS 84 geodetic', 4326, 'EPSG', 4326, 'GEOGCS["WGS 84",DATUM["WGS_1984",SPHEROID["WGS 84",6378137,298.257223563]],PRIMEM["Greenwich",0],UNIT["degree",0.0174532925199433]]', 'longitude/latitude coordinates in decimal degrees on the WGS 84 spheroid')`,
+		`CREATE TABLE gpkg_contents (
+		table_name TEXT NOT NULL PRIMARY KEY, data_type TEXT NOT NULL, identifier TEXT UNIQUE, description TEXT DEFAULT '',
+		last_change DATETIME NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ','now')),
+		min_x DOUBLE, min_y DOUBLE, max_x DOUBLE, max_y DOUBLE, srs_id INTEGER,
+		CONSTRAINT fk_gc_r_srs_id FOREIGN KEY (srs_id) REFERENCES gpkg_spatial_ref_sys(srs_id))`,
+		`CREATE TABLE gpkg_geometry_columns (
+		table_name TEXT NOT NULL, column_name TEXT NOT NULL, geometry_type_name TEXT NOT NULL,
+		srs_id INTEGER NOT NULL, z TINYINT NOT NULL, m TINYINT NOT NULL,
+		CONSTRAINT pk_geom_cols PRIMARY KEY (table_name, column_name),
+		CONSTRAINT fk_gc_tn FOREIGN KEY (table_name) REFERENCES gpkg_contents(table_name),
+		CONSTRAINT fk_gc_srs FOREIGN KEY (srs_id) REFERENCES gpkg_spatial_ref_sys (srs_id))`,
+	} {
+		if _, err := tx.Exec(query); err != nil {
+			return err
+		}
+	}
+
+	for _, t := range tables {
+		if err := writeGpkgFeatures(tx, t); err != nil {
+			return fmt.Errorf("table %s: %v", t.Name, err)
+		}
+	}
+
+	if len(metadata) == 0 {
+		return nil
+	}
+	if _, err := tx.Exec(`CREATE TABLE run_metadata (fid INTEGER PRIMARY KEY AUTOINCREMENT, key TEXT NOT NULL, value TEXT)`); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO gpkg_contents (table_name, data_type, identifier, description) VALUES ('run_metadata', 'attributes', 'run_metadata', 'Provenance of the run')`); err != nil {
+		return err
+	}
+	for _, a := range metadata {
+		if _, err := tx.Exec(`INSERT INTO run_metadata (key, value) VALUES (?, ?)`, a[0], a[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeGpkgFeatures creates and registers a feature table
+func writeGpkgFeatures(tx *sql.Tx, t FeatureTable) error {
+	columns := []string{"geom"}
+	defs := []string{"fid INTEGER PRIMARY KEY AUTOINCREMENT", "geom MULTIPOLYGON"}
+	if t.Names != nil {
+		columns = append(columns, "name")
+		defs = append(defs, "name TEXT")
+	}
+	for _, f := range t.Fields {
+		columns = append(columns, `"`+f.Name+`"`)
+		defs = append(defs, `"`+f.Name+`" REAL`)
+	}
+	if _, err := tx.Exec(fmt.Sprintf(`CREATE TABLE "%s" (%s)`, t.Name, strings.Join(defs, ", "))); err != nil {
+		return err
+	}
+
+	var b geom.Bounds
+	if len(t.Shapes) > 0 {
+		b = *t.Shapes[0].Bounds()
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", ")
+	stmt, err := tx.Prepare(fmt.Sprintf(`INSERT INTO "%s" (%s) VALUES (%s)`, t.Name, strings.Join(columns, ", "), placeholders))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for i, c := range t.Shapes {
+		b.Extend(c.Bounds())
+		g, err := GpkgGeometry(c)
+		if err != nil {
+			return fmt.Errorf("row %d: %v", i+1, err)
+		}
+		row := []interface{}{g}
+		if t.Names != nil {
+			row = append(row, t.Names[i])
+		}
+		for _, f := range t.Fields {
+			row = append(row, f.Values[i])
+		}
+		if _, err := stmt.Exec(row...); err != nil {
+			return fmt.Errorf("row %d: %v", i+1, err)
+		}
+	}
+
+	if _, err := tx.Exec(`INSERT INTO gpkg_contents (table_name, data_type, identifier, description, min_x, min_y, max_x, max_y, srs_id)
+		VALUES (?, 'features', ?, ?, ?, ?, ?, ?, ?)`, t.Name, t.Name, t.Description, b.Min.X, b.Min.Y, b.Max.X, b.Max.Y, GpkgSRS); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO gpkg_geometry_columns VALUES (?, 'geom', 'MULTIPOLYGON', ?, 0, 0)`, t.Name, GpkgSRS)
+	return err
+}
+
+// GpkgGeometry encodes a polygon as a GeoPackage geometry blob: the "GP"
+// header with the SRS and an XY envelope, followed by little-endian WKB
+func GpkgGeometry(c geom.Polygonal) ([]byte, error) {
+	b := c.Bounds()
+	header := make([]byte, 8+32)
+	copy(header, "GP")
+	header[2] = 0    // version 1
+	header[3] = 0x03 // little endian, XY envelope
+	binary.LittleEndian.PutUint32(header[4:], uint32(GpkgSRS))
+	for i, v := range []float64{b.Min.X, b.Max.X, b.Min.Y, b.Max.Y} {
+		binary.LittleEndian.PutUint64(header[8+8*i:], math.Float64bits(v))
+	}
+	body, err := wkb.Encode(geom.MultiPolygon(c.Polygons()), binary.LittleEndian)
+	if err != nil {
+		return nil, err
+	}
+	return append(header, body...), nil
+}
+
+// GpkgWKB strips the GeoPackage header from a geometry blob, leaving the WKB
+func GpkgWKB(geomBytes []byte) []byte {
+	if len(geomBytes) > 8 && geomBytes[0] == 'G' && geomBytes[1] == 'P' {
+		flags := geomBytes[3]
+		headerSize := 8
+		envelopeType := (flags >> 1) & 0x07
+		switch envelopeType {
+		case 1:
+			headerSize += 32
+		case 2, 3:
+			headerSize += 48
+		case 4:
+			headerSize += 64
+		}
+		return geomBytes[headerSize:]
+	}
+	return geomBytes
+}
+
+// gpkgFeatureTable opens a GeoPackage and finds its first feature table and
+// that table's geometry column
+func gpkgFeatureTable(gpkgFile string) (db *sql.DB, table, geomColumn string, err error) {
+	if _, err := os.Stat(gpkgFile); err != nil {
+		// sql.Open would create an empty database
+		return nil, "", "", err
+	}
+	db, err = sql.Open("sqlite3", gpkgFile)
+	if err != nil {
+		return nil, "", "", &FileError{File: gpkgFile, Err: err}
+	}
+	err = db.QueryRow("SELECT table_name FROM gpkg_contents WHERE data_type = 'features' LIMIT 1").Scan(&table)
+	if err != nil {
+		db.Close()
+		return nil, "", "", &FileError{File: gpkgFile, Err: fmt.Errorf("finding the feature table: %v", err)}
+	}
+	err = db.QueryRow("SELECT column_name FROM gpkg_geometry_columns WHERE table_name = ?", table).Scan(&geomColumn)
+	if err != nil {
+		db.Close()
+		return nil, "", "", &FileError{File: gpkgFile, Err: fmt.Errorf("finding the geometry column of %s: %v", table, err)}
+	}
+	return db, table, geomColumn, nil
+}
+
+// decodeGpkgPolygon decodes a GeoPackage geometry blob, returning nil if it
+// is not a polygon
+func decodeGpkgPolygon(geomBytes []byte) (geom.Polygonal, error) {
+	g, err := wkb.Decode(GpkgWKB(geomBytes))
+	if err != nil {
+		return nil, err
+	}
+	poly, _ := g.(geom.Polygonal)
+	return poly, nil
+}
+
+// gpkgPrimaryKey returns the name of the integer primary key column of a
+// table. GeoPackage feature tables must have one, usually but not always
+// named fid; rowid is used if there is none.
+func gpkgPrimaryKey(db *sql.DB, table string) (string, error) {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%q)", table))
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+	pk := "rowid"
+	for rows.Next() {
+		var cid, notNull, pkIndex int
+		var name, typ string
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &typ, &notNull, &dflt, &pkIndex); err != nil {
+			return "", err
+		}
+		if pkIndex == 1 {
+			pk = name
+		}
+	}
+	return pk, rows.Err()
+}
+
+// scanGpkgPolygons reads the polygons of the first feature table of a
+// GeoPackage in the order of its primary key (the fid), skipping non-polygon
+// features. For each polygon, the extra columns are scanned into dest and add
+// is called with the fid. All readers of feature tables go through it, so
+// that they agree on which features there are and in what order: the country
+// indices of a mapping refer to them.
+func scanGpkgPolygons(gpkgFile string, columns []string, dest []interface{}, add func(poly geom.Polygonal, fid int)) error {
+	db, table, geomColumn, err := gpkgFeatureTable(gpkgFile)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	pk, err := gpkgPrimaryKey(db, table)
+	if err != nil {
+		return &FileError{File: gpkgFile, Err: fmt.Errorf("finding the primary key of %s: %v", table, err)}
+	}
+
+	query := fmt.Sprintf("SELECT %s FROM %s ORDER BY %s", strings.Join(append([]string{geomColumn, pk}, columns...), ", "), table, pk)
+	rows, err := db.Query(query)
+	if err != nil {
+		return &FileError{File: gpkgFile, Err: err}
+	}
+	defer rows.Close()
+
+	var geomBytes []byte
+	var fid int
+	scanDest := append([]interface{}{&geomBytes, &fid}, dest...)
+	for row := 1; rows.Next(); row++ {
+		if err := rows.Scan(scanDest...); err != nil {
+			e := &FileError{File: gpkgFile, Row: row, Err: err}
+			if len(columns) == 1 {
+				e.Field = columns[0]
+			}
+			return e
+		}
+		poly, err := decodeGpkgPolygon(geomBytes)
+		if err != nil {
+			return &FileError{File: gpkgFile, Row: row, Err: err}
+		}
+		if poly != nil {
+			add(poly, fid)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return &FileError{File: gpkgFile, Err: err}
+	}
+	return nil
+}
+
+// ReadGeoPackageGeometries reads the polygons of the first feature table of a
+// GeoPackage in fid order. Non-polygon features are skipped.
+func ReadGeoPackageGeometries(gpkgFile string) ([]geom.Polygonal, error) {
+	var cells []geom.Polygonal
+	err := scanGpkgPolygons(gpkgFile, nil, nil, func(poly geom.Polygonal, _ int) {
+		cells = append(cells, poly)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cells, nil
+}
+
+// ReadGeoPackageFeatures reads the polygons of the first feature table of a
+// GeoPackage in fid order, with the text column nameColumn and the fids.
+// Non-polygon features are skipped, and features whose name is NULL are
+// named "fid <fid>".
+func ReadGeoPackageFeatures(gpkgFile, nameColumn string) ([]geom.Polygonal, []string, []int, error) {
+	var cells []geom.Polygonal
+	var names []string
+	var fids []int
+	var name sql.NullString
+	err := scanGpkgPolygons(gpkgFile, []string{nameColumn}, []interface{}{&name}, func(poly geom.Polygonal, fid int) {
+		cells = append(cells, poly)
+		if name.Valid {
+			names = append(names, name.String)
+		} else {
+			names = append(names, fmt.Sprintf("fid %d", fid))
+		}
+		fids = append(fids, fid)
+	})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return cells, names, fids, nil
+}
+
+// ReadGeoPackageNames reads the text column nameColumn of the polygon
+// features of the first feature table of a GeoPackage, in the same order as
+// ReadGeoPackageGeometries
+func ReadGeoPackageNames(gpkgFile, nameColumn string) ([]string, error) {
+	_, names, _, err := ReadGeoPackageFeatures(gpkgFile, nameColumn)
+	return names, err
+}
+
+// ReadGeoPackageField reads the polygons of the first feature table of a
+// GeoPackage in fid order with the numeric column field. Non-polygon
+// features are skipped.
+func ReadGeoPackageField(gpkgFile, field string) ([]geom.Polygonal, []float64, error) {
+	var cells []geom.Polygonal
+	var data []float64
+	var value float64
+	err := scanGpkgPolygons(gpkgFile, []string{field}, []interface{}{&value}, func(poly geom.Polygonal, _ int) {
+		cells = append(cells, poly)
+		data = append(data, value)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return cells, data, nil
+}
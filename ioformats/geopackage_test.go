@@ -0,0 +1,66 @@
+package ioformats
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	"github.com/ctessum/geom"
+)
+
+func square(x float64) geom.Polygonal {
+	return geom.Polygon{{{X: x, Y: 0}, {X: x + 1, Y: 0}, {X: x + 1, Y: 1}, {X: x, Y: 1}}}
+}
+
+func TestReadGeoPackageFeaturesCustomPrimaryKey(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "countries.gpkg")
+	err := WriteGeoPackage(file, []FeatureTable{{
+		Name:   "countries",
+		Shapes: []geom.Polygonal{square(0), square(1), square(2)},
+		Names:  []string{"A", "B", "C"},
+	}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// As GDAL may write it: a primary key not named fid, not in the order
+	// of the rows, and a NULL name
+	db, err := sql.Open("sqlite3", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range []string{
+		`ALTER TABLE countries RENAME COLUMN fid TO ogc_fid`,
+		`UPDATE countries SET ogc_fid = 10 + (3 - ogc_fid)`,
+		`UPDATE countries SET name = NULL WHERE ogc_fid = 11`,
+	} {
+		if _, err := db.Exec(q); err != nil {
+			t.Fatalf("%s: %v", q, err)
+		}
+	}
+	db.Close()
+
+	cells, names, fids, err := ReadGeoPackageFeatures(file, "name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantNames := []string{"C", "fid 11", "A"}
+	wantFIDs := []int{10, 11, 12}
+	wantX := []float64{2, 1, 0}
+	if len(cells) != 3 {
+		t.Fatalf("read %d features, want 3", len(cells))
+	}
+	for i := range cells {
+		if names[i] != wantNames[i] || fids[i] != wantFIDs[i] || cells[i].Bounds().Min.X != wantX[i] {
+			t.Errorf("feature %d: name %q, fid %d, x %g; want %q, %d, %g", i, names[i], fids[i], cells[i].Bounds().Min.X, wantNames[i], wantFIDs[i], wantX[i])
+		}
+	}
+	geoms, err := ReadGeoPackageGeometries(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range geoms {
+		if geoms[i].Bounds().Min.X != wantX[i] {
+			t.Errorf("geometry %d starts at x=%g, want %g", i, geoms[i].Bounds().Min.X, wantX[i])
+		}
+	}
+}
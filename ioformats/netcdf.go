@@ -0,0 +1,863 @@
+package ioformats
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+
+	"github.com/ctessum/geom"
+	"github.com/fhs/go-netcdf/netcdf"
+
+	"mortality/regrid"
+)
+
+// ncMu serialises calls into the NetCDF C library, which is not thread-safe,
+// so that files can be read and written from several goroutines
+var ncMu sync.Mutex
+
+// ReadNetCDF reads a field from a NetCDF file that follows the CF
+// conventions, returning a rectangular cell for each latitude/longitude point,
+// in rows of longitudes, and the value of the field in it. The longitude and
+// latitude dimensions are found from their coordinate variables (see cfAxis)
+// rather than by name, and the cells span their bounds variables if they have
+// them, or reach halfway to the neighbouring points otherwise, so grids may be
+// irregular and run in either direction. Besides latitude and longitude, the
+// field may have a vertical dimension, from which layer is read (0 is the
+// level nearest the ground; see surfaceLast), a time dimension, from which
+// time is read, and other dimensions of length 1. Packed values are unpacked
+// with scale_factor and add_offset, and fill values, missing values and
+// values outside the valid range are NaN. The cells are in longitude/latitude
+// (crs.WGS84), with longitudes from -180 to 180° whatever their range in the
+// file.
+func ReadNetCDF(ncFile, varName string, layer, time int) ([]geom.Polygonal, []float64, error) {
+	if layer < 0 {
+		return nil, nil, &FileError{File: ncFile, Err: fmt.Errorf("invalid layer index %d", layer)}
+	}
+	if time < 0 {
+		return nil, nil, &FileError{File: ncFile, Err: fmt.Errorf("invalid time index %d", time)}
+	}
+	ncMu.Lock()
+	defer ncMu.Unlock()
+	ds, err := netcdf.OpenFile(ncFile, netcdf.NOWRITE)
+	if err != nil {
+		return nil, nil, &FileError{File: ncFile, Err: err}
+	}
+	defer ds.Close()
+
+	f, err := openField(ds, varName)
+	if err != nil {
+		return nil, nil, &FileError{File: ncFile, Field: varName, Err: err}
+	}
+	g, err := f.grid()
+	if err != nil {
+		return nil, nil, &FileError{File: ncFile, Field: varName, Err: err}
+	}
+	data, err := f.read(layer, time)
+	if err != nil {
+		return nil, nil, &FileError{File: ncFile, Field: varName, Err: err}
+	}
+	return g.Cells(), data, nil
+}
+
+// ncField is a variable of a NetCDF file, with the CF axis of each of its
+// dimensions and the coordinate variable along it
+type ncField struct {
+	ds     netcdf.Dataset
+	v      netcdf.Var
+	dims   []string
+	lens   []uint64
+	axes   []byte   // 'X', 'Y', 'Z', 'T', or 0 for other dimensions of length 1
+	coords []string // Coordinate variable of each dimension; "" if there is none
+	// lonOrder is the index along the longitude dimension of each column of
+	// the grid after wrapping the longitudes to -180 to 180°; nil if they
+	// were not moved
+	lonOrder []int
+}
+
+var axisNames = map[byte]string{'X': "longitude", 'Y': "latitude", 'Z': "vertical", 'T': "time"}
+
+// openField finds a variable and classifies its dimensions. The coordinate
+// variable of a dimension is the one-dimensional variable with its name, or
+// else one along it listed in the coordinates attribute of the variable.
+func openField(ds netcdf.Dataset, name string) (*ncField, error) {
+	v, err := ds.Var(name)
+	if err != nil {
+		return nil, fmt.Errorf("no such variable (%v); the file has %s", err, strings.Join(varNames(ds), ", "))
+	}
+	dims, err := v.Dims()
+	if err != nil {
+		return nil, err
+	}
+	f := &ncField{ds: ds, v: v}
+	aux := strings.Fields(attrString(v, "coordinates"))
+	for _, c := range aux {
+		cv, err := ds.Var(c)
+		if err != nil {
+			continue
+		}
+		if cd, err := cv.Dims(); err == nil && len(cd) > 1 {
+			if a := cfAxis(c, func(a string) string { return attrString(cv, a) }); a == 'X' || a == 'Y' {
+				return nil, fmt.Errorf("its %ss, %s, are %d-dimensional; curvilinear grids are not supported, only grids with one-dimensional latitude and longitude", axisNames[a], c, len(cd))
+			}
+		}
+	}
+	for _, d := range dims {
+		dn, err := d.Name()
+		if err != nil {
+			return nil, err
+		}
+		n, err := d.Len()
+		if err != nil {
+			return nil, err
+		}
+		coord := ""
+		for _, c := range append([]string{dn}, aux...) {
+			if cv, err := ds.Var(c); err == nil && alongDim(cv, dn) {
+				coord = c
+				break
+			}
+		}
+		attr := func(string) string { return "" }
+		if coord != "" {
+			cv, _ := ds.Var(coord)
+			attr = func(a string) string { return attrString(cv, a) }
+		}
+		axis := cfAxis(dn, attr)
+		if coord != "" {
+			axis = cfAxis(coord, attr)
+		}
+		switch {
+		case (axis == 'X' || axis == 'Y') && coord == "":
+			return nil, fmt.Errorf("dimension %s has no coordinate variable giving its %ss", dn, axisNames[axis])
+		case axis == 0 && n != 1:
+			return nil, fmt.Errorf("dimension %s (length %d) is not longitude, latitude, vertical or time; other dimensions must have length 1", dn, n)
+		}
+		for i, a := range f.axes {
+			if axis != 0 && a == axis {
+				return nil, fmt.Errorf("dimensions %s and %s are both %s", f.dims[i], dn, axisNames[axis])
+			}
+		}
+		f.dims = append(f.dims, dn)
+		f.lens = append(f.lens, n)
+		f.axes = append(f.axes, axis)
+		f.coords = append(f.coords, coord)
+	}
+	for _, a := range []byte{'X', 'Y'} {
+		if f.axis(a) < 0 {
+			return nil, fmt.Errorf("no %s dimension among (%s)", axisNames[a], strings.Join(f.dims, ", "))
+		}
+	}
+	return f, nil
+}
+
+// axis returns the index of the dimension with a CF axis, or -1
+func (f *ncField) axis(a byte) int {
+	for i, x := range f.axes {
+		if x == a {
+			return i
+		}
+	}
+	return -1
+}
+
+// coord reads the coordinate variable of dimension i
+func (f *ncField) coord(i int) (netcdf.Var, []float64, error) {
+	v, err := f.ds.Var(f.coords[i])
+	if err != nil {
+		return v, nil, err
+	}
+	values, _, err := readUnpacked(v, []uint64{0}, []uint64{f.lens[i]})
+	if err != nil {
+		return v, nil, fmt.Errorf("%s: %v", f.coords[i], err)
+	}
+	return v, values, nil
+}
+
+// grid reads the latitudes and longitudes of the field and their bounds,
+// from the variable named by the bounds attribute of each coordinate or
+// else <coordinate>_bnds. Longitudes are wrapped to -180 to 180° (see
+// wrapLongitudes), and read puts the data in the same order.
+func (f *ncField) grid() (*LatLonGrid, error) {
+	g := new(LatLonGrid)
+	for _, c := range []struct {
+		axis    byte
+		centres *[]float64
+		bounds  *[][2]float64
+	}{{'Y', &g.Lat, &g.LatBounds}, {'X', &g.Lon, &g.LonBounds}} {
+		i := f.axis(c.axis)
+		name := f.coords[i]
+		v, centres, err := f.coord(i)
+		if err != nil {
+			return nil, err
+		}
+		var bnds []float64
+		bname := attrString(v, "bounds")
+		bv, err := f.ds.Var(bname)
+		if bname == "" {
+			bname = name + "_bnds"
+			bv, err = f.ds.Var(bname)
+			if err != nil {
+				bname = ""
+			}
+		} else if err != nil {
+			return nil, fmt.Errorf("%s: bounds variable %s: %v", name, bname, err)
+		}
+		if bname != "" {
+			if bnds, _, err = readUnpacked(bv, []uint64{0, 0}, []uint64{f.lens[i], 2}); err != nil {
+				return nil, fmt.Errorf("%s: bounds variable %s: %v", name, bname, err)
+			}
+		}
+		if *c.bounds, err = cellBounds(centres, bnds, c.axis == 'Y'); err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		if c.axis == 'X' {
+			centres, *c.bounds, f.lonOrder = wrapLongitudes(centres, *c.bounds)
+		}
+		if c.axis == 'Y' {
+			for _, lat := range centres {
+				if lat < -90 || lat > 90 {
+					return nil, fmt.Errorf("%s: latitude %g is outside -90 to 90", name, lat)
+				}
+			}
+		}
+		*c.centres = centres
+	}
+	return g, nil
+}
+
+// read reads the field at a vertical layer, counted up from the ground, and
+// a time index, in rows of longitudes in the order of grid, which must be
+// called first
+func (f *ncField) read(layer, time int) ([]float64, error) {
+	start := make([]uint64, len(f.dims))
+	count := make([]uint64, len(f.dims))
+	for i, a := range f.axes {
+		count[i] = 1
+		switch a {
+		case 'X', 'Y':
+			count[i] = f.lens[i]
+		case 'Z':
+			if uint64(layer) >= f.lens[i] {
+				return nil, fmt.Errorf("layer %d is out of range; %s has %d levels", layer, f.dims[i], f.lens[i])
+			}
+			start[i] = uint64(layer)
+			if f.coords[i] != "" {
+				v, levels, err := f.coord(i)
+				if err != nil {
+					return nil, err
+				}
+				if surfaceLast(levels, attrString(v, "units")) {
+					start[i] = f.lens[i] - 1 - uint64(layer)
+				}
+			}
+		case 'T':
+			if uint64(time) >= f.lens[i] {
+				return nil, fmt.Errorf("time %d is out of range; %s has %d times", time, f.dims[i], f.lens[i])
+			}
+			start[i] = uint64(time)
+		}
+	}
+	if f.axis('Z') < 0 && layer != 0 {
+		return nil, fmt.Errorf("no vertical dimension among (%s), so the layer must be 0, not %d", strings.Join(f.dims, ", "), layer)
+	}
+	if f.axis('T') < 0 && time != 0 {
+		return nil, fmt.Errorf("no time dimension among (%s), so the time must be 0, not %d", strings.Join(f.dims, ", "), time)
+	}
+	data, _, err := readUnpacked(f.v, start, count)
+	if err != nil {
+		return nil, err
+	}
+	// The values are in the order of the dimensions; put latitude first
+	if x, y := f.axis('X'), f.axis('Y'); x < y {
+		nx, ny := int(f.lens[x]), int(f.lens[y])
+		rows := make([]float64, len(data))
+		for i := 0; i < nx; i++ {
+			for j := 0; j < ny; j++ {
+				rows[j*nx+i] = data[i*ny+j]
+			}
+		}
+		data = rows
+	}
+	if f.lonOrder != nil {
+		nx := len(f.lonOrder)
+		rows := make([]float64, len(data))
+		for j := 0; j < len(data)/nx; j++ {
+			for i, o := range f.lonOrder {
+				rows[j*nx+i] = data[j*nx+o]
+			}
+		}
+		data = rows
+	}
+	return data, nil
+}
+
+// alongDim reports whether v is one-dimensional along the dimension dim
+func alongDim(v netcdf.Var, dim string) bool {
+	dims, err := v.Dims()
+	if err != nil || len(dims) != 1 {
+		return false
+	}
+	name, err := dims[0].Name()
+	return err == nil && name == dim
+}
+
+// varNames lists the variables of a file
+func varNames(ds netcdf.Dataset) []string {
+	n, _ := ds.NVars()
+	var names []string
+	for i := 0; i < n; i++ {
+		if name, err := ds.VarN(i).Name(); err == nil {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// attrString returns a text attribute, or "" if there is none
+func attrString(v netcdf.Var, name string) string {
+	a := v.Attr(name)
+	if t, err := a.Type(); err != nil || t != netcdf.CHAR {
+		return ""
+	}
+	n, err := a.Len()
+	if err != nil || n == 0 {
+		return ""
+	}
+	b := make([]byte, n)
+	if err := a.ReadBytes(b); err != nil {
+		return ""
+	}
+	return strings.TrimRight(string(b), "\x00")
+}
+
+// attrFloats returns a numeric attribute, or nil if there is none
+func attrFloats(v netcdf.Var, name string) ([]float64, error) {
+	a := v.Attr(name)
+	t, err := a.Type()
+	if err != nil {
+		return nil, nil // No such attribute
+	}
+	n, err := a.Len()
+	if err != nil || n == 0 {
+		return nil, err
+	}
+	out := make([]float64, n)
+	switch t {
+	case netcdf.DOUBLE:
+		err = a.ReadFloat64s(out)
+	case netcdf.FLOAT:
+		buf := make([]float32, n)
+		err = a.ReadFloat32s(buf)
+		for i, x := range buf {
+			out[i] = float64(x)
+		}
+	case netcdf.BYTE:
+		buf := make([]int8, n)
+		err = a.ReadInt8s(buf)
+		for i, x := range buf {
+			out[i] = float64(x)
+		}
+	case netcdf.UBYTE:
+		buf := make([]uint8, n)
+		err = a.ReadUint8s(buf)
+		for i, x := range buf {
+			out[i] = float64(x)
+		}
+	case netcdf.SHORT:
+		buf := make([]int16, n)
+		err = a.ReadInt16s(buf)
+		for i, x := range buf {
+			out[i] = float64(x)
+		}
+	case netcdf.USHORT:
+		buf := make([]uint16, n)
+		err = a.ReadUint16s(buf)
+		for i, x := range buf {
+			out[i] = float64(x)
+		}
+	case netcdf.INT:
+		buf := make([]int32, n)
+		err = a.ReadInt32s(buf)
+		for i, x := range buf {
+			out[i] = float64(x)
+		}
+	case netcdf.UINT:
+		buf := make([]uint32, n)
+		err = a.ReadUint32s(buf)
+		for i, x := range buf {
+			out[i] = float64(x)
+		}
+	case netcdf.INT64:
+		buf := make([]int64, n)
+		err = a.ReadInt64s(buf)
+		for i, x := range buf {
+			out[i] = float64(x)
+		}
+	case netcdf.UINT64:
+		buf := make([]uint64, n)
+		err = a.ReadUint64s(buf)
+		for i, x := range buf {
+			out[i] = float64(x)
+		}
+	default:
+		return nil, fmt.Errorf("attribute %s is of type %v, not a number", name, t)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("attribute %s: %v", name, err)
+	}
+	return out, nil
+}
+
+// readSlice reads a hyperslab of a numeric variable of any type as float64
+func readSlice(v netcdf.Var, start, count []uint64) ([]float64, netcdf.Type, error) {
+	t, err := v.Type()
+	if err != nil {
+		return nil, t, err
+	}
+	n := 1
+	for _, c := range count {
+		n *= int(c)
+	}
+	out := make([]float64, n)
+	switch t {
+	case netcdf.DOUBLE:
+		err = v.ReadFloat64Slice(out, start, count)
+	case netcdf.FLOAT:
+		buf := make([]float32, n)
+		err = v.ReadFloat32Slice(buf, start, count)
+		for i, x := range buf {
+			out[i] = float64(x)
+		}
+	case netcdf.BYTE:
+		buf := make([]int8, n)
+		err = v.ReadInt8Slice(buf, start, count)
+		for i, x := range buf {
+			out[i] = float64(x)
+		}
+	case netcdf.UBYTE:
+		buf := make([]uint8, n)
+		err = v.ReadUint8Slice(buf, start, count)
+		for i, x := range buf {
+			out[i] = float64(x)
+		}
+	case netcdf.SHORT:
+		buf := make([]int16, n)
+		err = v.ReadInt16Slice(buf, start, count)
+		for i, x := range buf {
+			out[i] = float64(x)
+		}
+	case netcdf.USHORT:
+		buf := make([]uint16, n)
+		err = v.ReadUint16Slice(buf, start, count)
+		for i, x := range buf {
+			out[i] = float64(x)
+		}
+	case netcdf.INT:
+		buf := make([]int32, n)
+		err = v.ReadInt32Slice(buf, start, count)
+		for i, x := range buf {
+			out[i] = float64(x)
+		}
+	case netcdf.UINT:
+		buf := make([]uint32, n)
+		err = v.ReadUint32Slice(buf, start, count)
+		for i, x := range buf {
+			out[i] = float64(x)
+		}
+	case netcdf.INT64:
+		buf := make([]int64, n)
+		err = v.ReadInt64Slice(buf, start, count)
+		for i, x := range buf {
+			out[i] = float64(x)
+		}
+	case netcdf.UINT64:
+		buf := make([]uint64, n)
+		err = v.ReadUint64Slice(buf, start, count)
+		for i, x := range buf {
+			out[i] = float64(x)
+		}
+	default:
+		return nil, t, fmt.Errorf("unsupported data type %v", t)
+	}
+	return out, t, err
+}
+
+// defaultFill is the fill value the NetCDF library gives unwritten values of
+// each type when a variable has no _FillValue. Bytes have none, as their
+// default fill is also a valid value.
+var defaultFill = map[netcdf.Type]float64{
+	netcdf.SHORT:  -32767,
+	netcdf.USHORT: 65535,
+	netcdf.INT:    -2147483647,
+	netcdf.UINT:   4294967295,
+	netcdf.INT64:  -9223372036854775806,
+	netcdf.UINT64: 18446744073709551614,
+	netcdf.FLOAT:  9.9692099683868690e+36,
+	netcdf.DOUBLE: 9.9692099683868690e+36,
+}
+
+// readPacking reads the packing and missing value attributes of a variable
+func readPacking(v netcdf.Var, t netcdf.Type) (packing, error) {
+	p := packing{scale: 1, validMin: math.Inf(-1), validMax: math.Inf(1)}
+	attrs := make(map[string][]float64)
+	for _, name := range []string{"scale_factor", "add_offset", "_FillValue", "missing_value", "valid_range", "valid_min", "valid_max"} {
+		values, err := attrFloats(v, name)
+		if err != nil {
+			return p, err
+		}
+		attrs[name] = values
+	}
+	if s := attrs["scale_factor"]; len(s) > 0 {
+		p.scale = s[0]
+	}
+	if o := attrs["add_offset"]; len(o) > 0 {
+		p.offset = o[0]
+	}
+	p.fill = append(attrs["_FillValue"], attrs["missing_value"]...)
+	if f, ok := defaultFill[t]; ok && len(attrs["_FillValue"]) == 0 {
+		p.fill = append(p.fill, f)
+	}
+	if r := attrs["valid_range"]; len(r) == 2 {
+		p.validMin, p.validMax = r[0], r[1]
+	}
+	if m := attrs["valid_min"]; len(m) > 0 {
+		p.validMin = m[0]
+	}
+	if m := attrs["valid_max"]; len(m) > 0 {
+		p.validMax = m[0]
+	}
+	return p, nil
+}
+
+// readUnpacked reads a hyperslab of a variable and unpacks it, returning the
+// number of missing values, which are NaN
+func readUnpacked(v netcdf.Var, start, count []uint64) ([]float64, int, error) {
+	data, t, err := readSlice(v, start, count)
+	if err != nil {
+		return nil, 0, err
+	}
+	p, err := readPacking(v, t)
+	if err != nil {
+		return nil, 0, err
+	}
+	return data, p.apply(data), nil
+}
+
+// LatLonGrid is a rectilinear grid: the latitudes and longitudes of the cell
+// centres, and the lower and upper bounds of each row and column, in the
+// order of the file they were read from, except that longitudes are wrapped
+// to -180 to 180° and kept in order
+type LatLonGrid struct {
+	Lat, Lon             []float64
+	LatBounds, LonBounds [][2]float64
+}
+
+// ReadLatLonGrid reads the grid of a variable of a NetCDF file, as ReadNetCDF
+// does
+func ReadLatLonGrid(ncFile, varName string) (*LatLonGrid, error) {
+	ncMu.Lock()
+	defer ncMu.Unlock()
+	ds, err := netcdf.OpenFile(ncFile, netcdf.NOWRITE)
+	if err != nil {
+		return nil, &FileError{File: ncFile, Err: err}
+	}
+	defer ds.Close()
+	f, err := openField(ds, varName)
+	if err != nil {
+		return nil, &FileError{File: ncFile, Field: varName, Err: err}
+	}
+	g, err := f.grid()
+	if err != nil {
+		return nil, &FileError{File: ncFile, Field: varName, Err: err}
+	}
+	return g, nil
+}
+
+// Cells returns the grid cells in the same order as ReadNetCDF: latitude rows
+// of longitudes
+func (g *LatLonGrid) Cells() []geom.Polygonal {
+	cells := make([]geom.Polygonal, 0, len(g.Lat)*len(g.Lon))
+	for _, lat := range g.LatBounds {
+		for _, lon := range g.LonBounds {
+			cells = append(cells, &geom.Bounds{
+				Min: geom.Point{X: lon[0], Y: lat[0]},
+				Max: geom.Point{X: lon[1], Y: lat[1]},
+			})
+		}
+	}
+	return cells
+}
+
+// CellEdges returns the n+1 cell edges of n cell centres, halfway between
+// neighbouring centres and extrapolated at the ends
+func CellEdges(centres []float64) []float64 {
+	n := len(centres)
+	edges := make([]float64, n+1)
+	if n == 1 {
+		// No spacing to go by; treat the cell as a point
+		edges[0], edges[1] = centres[0], centres[0]
+		return edges
+	}
+	for i := 1; i < n; i++ {
+		edges[i] = (centres[i-1] + centres[i]) / 2
+	}
+	edges[0] = centres[0] - (edges[1] - centres[0])
+	edges[n] = centres[n-1] + (centres[n-1] - edges[n-1])
+	return edges
+}
+
+// flatBounds converts cell bounds to a CF bounds array of (lower, upper)
+// pairs
+func flatBounds(bounds [][2]float64) []float64 {
+	flat := make([]float64, 0, 2*len(bounds))
+	for _, b := range bounds {
+		flat = append(flat, b[0], b[1])
+	}
+	return flat
+}
+
+// NetCDFOptions controls how WriteNetCDF lays out and describes its output
+type NetCDFOptions struct {
+	// Grid, if not nil, is a lat/lon grid onto which the fields are
+	// regridded by area-weighted sum, so totals are conserved. Otherwise the
+	// cells are written as an unstructured mesh along a cell dimension.
+	Grid *LatLonGrid
+	// Area measures the cells when regridding onto Grid (regrid.Planar if
+	// nil)
+	Area regrid.AreaFunc
+	// Attributes returns the CF long_name and units of a field
+	Attributes func(name string) (longName, units string)
+	// Global lists the global attributes as name/value pairs
+	Global [][2]string
+}
+
+// WriteNetCDF writes fields to a CF-compliant NetCDF file, with one variable
+// per field. On an unstructured mesh, the centroid and vertices of each cell
+// are written as lon, lat, lon_bnds and lat_bnds (see cellVertices). The
+// cells must be in longitude/latitude. NaN values are written as the
+// _FillValue of their variable, so that CF readers treat them as missing.
+func WriteNetCDF(cells []geom.Polygonal, fields []Field, filename string, opts NetCDFOptions) (err error) {
+	// Regrid before taking the lock, so other files can be read and written
+	// while the cells are intersected
+	fill := defaultFill[netcdf.DOUBLE]
+	values := make([][]float64, len(fields))
+	var weights *regrid.Weights
+	if opts.Grid != nil {
+		weights = regrid.ComputeWeights(cells, opts.Grid.Cells(), opts.Area)
+	}
+	for k, f := range fields {
+		v := f.Values
+		if weights != nil {
+			if v, err = weights.Sum(f.Values); err != nil {
+				return fmt.Errorf("regridding %s: %v", f.Name, err)
+			}
+		}
+		values[k] = make([]float64, len(v))
+		for i, x := range v {
+			if math.IsNaN(x) {
+				x = fill
+			}
+			values[k][i] = x
+		}
+	}
+
+	ncMu.Lock()
+	defer ncMu.Unlock()
+	ds, err := netcdf.CreateFile(filename, netcdf.CLOBBER|netcdf.NETCDF4)
+	if err != nil {
+		return &FileError{File: filename, Err: err}
+	}
+	defer func() {
+		if cerr := ds.Close(); err == nil && cerr != nil {
+			err = &FileError{File: filename, Err: cerr}
+		}
+	}()
+	wrap := func(err error) error {
+		return &FileError{File: filename, Err: err}
+	}
+	writeAttrs := func(v netcdf.Var, attrs [][2]string) error {
+		for _, a := range attrs {
+			if err := v.Attr(a[0]).WriteBytes([]byte(a[1])); err != nil {
+				return fmt.Errorf("attribute %s: %v", a[0], err)
+			}
+		}
+		return nil
+	}
+
+	type coordVar struct {
+		v    netcdf.Var
+		data []float64
+	}
+	var coords []coordVar
+	addCoord := func(name string, dims []netcdf.Dim, data []float64, attrs [][2]string) error {
+		v, err := ds.AddVar(name, netcdf.DOUBLE, dims)
+		if err != nil {
+			return fmt.Errorf("variable %s: %v", name, err)
+		}
+		if err := writeAttrs(v, attrs); err != nil {
+			return fmt.Errorf("variable %s: %v", name, err)
+		}
+		coords = append(coords, coordVar{v, data})
+		return nil
+	}
+	addDims := func(names []string, lens []int) ([]netcdf.Dim, error) {
+		dims := make([]netcdf.Dim, len(names))
+		for i, name := range names {
+			d, err := ds.AddDim(name, uint64(lens[i]))
+			if err != nil {
+				return nil, fmt.Errorf("dimension %s: %v", name, err)
+			}
+			dims[i] = d
+		}
+		return dims, nil
+	}
+
+	var dataDims []netcdf.Dim
+	if g := opts.Grid; g != nil {
+		dims, err := addDims([]string{"lat", "lon", "nv"}, []int{len(g.Lat), len(g.Lon), 2})
+		if err != nil {
+			return wrap(err)
+		}
+		latDim, lonDim, nvDim := dims[0], dims[1], dims[2]
+		for _, c := range []struct {
+			name  string
+			dims  []netcdf.Dim
+			data  []float64
+			attrs [][2]string
+		}{
+			{"lat", []netcdf.Dim{latDim}, g.Lat, [][2]string{{"standard_name", "latitude"}, {"units", "degrees_north"}, {"axis", "Y"}, {"bounds", "lat_bnds"}}},
+			{"lon", []netcdf.Dim{lonDim}, g.Lon, [][2]string{{"standard_name", "longitude"}, {"units", "degrees_east"}, {"axis", "X"}, {"bounds", "lon_bnds"}}},
+			{"lat_bnds", []netcdf.Dim{latDim, nvDim}, flatBounds(g.LatBounds), nil},
+			{"lon_bnds", []netcdf.Dim{lonDim, nvDim}, flatBounds(g.LonBounds), nil},
+		} {
+			if err := addCoord(c.name, c.dims, c.data, c.attrs); err != nil {
+				return wrap(err)
+			}
+		}
+		dataDims = []netcdf.Dim{latDim, lonDim}
+	} else {
+		lon, lat, lonBnds, latBnds, nv := cellVertices(cells, fill)
+		dims, err := addDims([]string{"cell", "nv"}, []int{len(cells), nv})
+		if err != nil {
+			return wrap(err)
+		}
+		cellDim, nvDim := dims[0], dims[1]
+		for _, c := range []struct {
+			name  string
+			dims  []netcdf.Dim
+			data  []float64
+			attrs [][2]string
+		}{
+			{"lat", []netcdf.Dim{cellDim}, lat, [][2]string{{"standard_name", "latitude"}, {"units", "degrees_north"}, {"bounds", "lat_bnds"}}},
+			{"lon", []netcdf.Dim{cellDim}, lon, [][2]string{{"standard_name", "longitude"}, {"units", "degrees_east"}, {"bounds", "lon_bnds"}}},
+			{"lat_bnds", []netcdf.Dim{cellDim, nvDim}, latBnds, nil},
+			{"lon_bnds", []netcdf.Dim{cellDim, nvDim}, lonBnds, nil},
+		} {
+			if err := addCoord(c.name, c.dims, c.data, c.attrs); err != nil {
+				return wrap(err)
+			}
+			if c.attrs == nil {
+				// Vertices beyond those of a cell are padding
+				if err := coords[len(coords)-1].v.Attr("_FillValue").WriteFloat64s([]float64{fill}); err != nil {
+					return wrap(fmt.Errorf("variable %s: attribute _FillValue: %v", c.name, err))
+				}
+			}
+		}
+		dataDims = []netcdf.Dim{cellDim}
+	}
+
+	vars := make([]netcdf.Var, len(fields))
+	for k, f := range fields {
+		vars[k], err = ds.AddVar(f.Name, netcdf.DOUBLE, dataDims)
+		if err != nil {
+			return wrap(fmt.Errorf("variable %s: %v", f.Name, err))
+		}
+		var attrs [][2]string
+		if opts.Attributes != nil {
+			longName, units := opts.Attributes(f.Name)
+			attrs = append(attrs, [2]string{"long_name", longName}, [2]string{"units", units})
+		}
+		if opts.Grid == nil {
+			attrs = append(attrs, [2]string{"coordinates", "lon lat"})
+		}
+		if err := writeAttrs(vars[k], attrs); err != nil {
+			return wrap(fmt.Errorf("variable %s: %v", f.Name, err))
+		}
+		if err := vars[k].Attr("_FillValue").WriteFloat64s([]float64{fill}); err != nil {
+			return wrap(fmt.Errorf("variable %s: attribute _FillValue: %v", f.Name, err))
+		}
+	}
+	for _, a := range opts.Global {
+		if err := ds.Attr(a[0]).WriteBytes([]byte(a[1])); err != nil {
+			return wrap(fmt.Errorf("global attribute %s: %v", a[0], err))
+		}
+	}
+	if err := ds.EndDef(); err != nil {
+		return wrap(err)
+	}
+
+	for _, c := range coords {
+		if err := c.v.WriteFloat64s(c.data); err != nil {
+			return wrap(err)
+		}
+	}
+	for k, f := range fields {
+		if err := vars[k].WriteFloat64s(values[k]); err != nil {
+			return wrap(fmt.Errorf("variable %s: %v", f.Name, err))
+		}
+	}
+	return nil
+}
+
+// cellVertices returns the centroid of each cell and the vertices of its
+// outer ring (of its first polygon, if it has several), counterclockwise as
+// CF requires, without repeating the first vertex. The vertices are flattened
+// in rows of nv, the largest number of vertices of any cell, and the rows of
+// cells with fewer are padded with fill.
+func cellVertices(cells []geom.Polygonal, fill float64) (lon, lat, lonBnds, latBnds []float64, nv int) {
+	rings := make([][]geom.Point, len(cells))
+	for i, c := range cells {
+		polys := c.Polygons()
+		if len(polys) == 0 || len(polys[0]) == 0 {
+			continue
+		}
+		ring := polys[0][0]
+		if n := len(ring); n > 1 && ring[0] == ring[n-1] {
+			ring = ring[:n-1]
+		}
+		var area2 float64 // Twice the signed area; negative if clockwise
+		for j := range ring {
+			p, q := ring[j], ring[(j+1)%len(ring)]
+			area2 += p.X*q.Y - q.X*p.Y
+		}
+		if area2 < 0 {
+			rev := make([]geom.Point, len(ring))
+			for j, p := range ring {
+				rev[len(ring)-1-j] = p
+			}
+			ring = rev
+		}
+		rings[i] = ring
+		if len(ring) > nv {
+			nv = len(ring)
+		}
+	}
+	lon = make([]float64, len(cells))
+	lat = make([]float64, len(cells))
+	lonBnds = make([]float64, nv*len(cells))
+	latBnds = make([]float64, nv*len(cells))
+	for i, c := range cells {
+		centre := c.Centroid()
+		lon[i], lat[i] = centre.X, centre.Y
+		for j := 0; j < nv; j++ {
+			k := i*nv + j
+			if j < len(rings[i]) {
+				lonBnds[k], latBnds[k] = rings[i][j].X, rings[i][j].Y
+			} else {
+				lonBnds[k], latBnds[k] = fill, fill
+			}
+		}
+	}
+	return lon, lat, lonBnds, latBnds, nv
+}
@@ -0,0 +1,183 @@
+// Package ioformats reads and writes the gridded inputs and outputs of the
+// health impact calculation: shapefiles, NetCDF files, GeoPackages and CSV
+// tables.
+package ioformats
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/ctessum/geom"
+	"github.com/ctessum/geom/encoding/shp"
+	jshp "github.com/jonas-p/go-shp"
+)
+
+// Field is a named per-cell attribute of an output
+type Field struct {
+	Name   string
+	Values []float64
+}
+
+// ReadShapefile reads the polygons of a shapefile and the numeric attribute
+// field. Spaces and NUL padding in the attribute are ignored.
+func ReadShapefile(shpFile, field string) ([]geom.Polygonal, []float64, error) {
+	s, err := shp.NewDecoder(shpFile)
+	if err != nil {
+		return nil, nil, &FileError{File: shpFile, Err: err}
+	}
+	defer s.Close()
+
+	var data []float64
+	var cells []geom.Polygonal
+	for row := 1; ; row++ {
+		g, fields, more := s.DecodeRowFields(field)
+		if !more {
+			break
+		}
+		raw, ok := fields[field]
+		if !ok {
+			return nil, nil, &FileError{File: shpFile, Field: field, Err: errors.New("no such field")}
+		}
+		mm := strings.Replace(raw, " ", "", -1)
+		v, err := strconv.ParseFloat(strings.Replace(mm, "\x00", "", -1), 64)
+		if err != nil {
+			return nil, nil, &FileError{File: shpFile, Row: row, Field: field, Err: err}
+		}
+		p, ok := g.(geom.Polygonal)
+		if !ok {
+			return nil, nil, &FileError{File: shpFile, Row: row, Err: fmt.Errorf("geometry is %T, not a polygon", g)}
+		}
+		cells = append(cells, p)
+		data = append(data, v)
+	}
+	if err := s.Error(); err != nil {
+		return nil, nil, &FileError{File: shpFile, Err: err}
+	}
+	return cells, data, nil
+}
+
+// ReadShapefileGeometries reads just the polygons of a shapefile
+func ReadShapefileGeometries(shpFile string) ([]geom.Polygonal, error) {
+	s, err := shp.NewDecoder(shpFile)
+	if err != nil {
+		return nil, &FileError{File: shpFile, Err: err}
+	}
+	defer s.Close()
+
+	var cells []geom.Polygonal
+	for row := 1; ; row++ {
+		// DecodeRowFields with no fields still gives us the geometry
+		g, _, more := s.DecodeRowFields()
+		if !more {
+			break
+		}
+		p, ok := g.(geom.Polygonal)
+		if !ok {
+			return nil, &FileError{File: shpFile, Row: row, Err: fmt.Errorf("geometry is %T, not a polygon", g)}
+		}
+		cells = append(cells, p)
+	}
+	if err := s.Error(); err != nil {
+		return nil, &FileError{File: shpFile, Err: err}
+	}
+	return cells, nil
+}
+
+// ShapefileRows returns the number of records in a shapefile, read from the
+// header of its .dbf file without decoding the geometries
+func ShapefileRows(shpFile string) (int, error) {
+	dbfFile := strings.TrimSuffix(shpFile, filepath.Ext(shpFile)) + ".dbf"
+	f, err := os.Open(dbfFile)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	// Version, date of last update and then the record count
+	var header [8]byte
+	if _, err := io.ReadFull(f, header[:]); err != nil {
+		return 0, &FileError{File: dbfFile, Err: err}
+	}
+	return int(binary.LittleEndian.Uint32(header[4:])), nil
+}
+
+// WriteTotDeaths writes a shapefile with deaths in a single TotalPopD field.
+// Only the first polygon of each cell is written.
+func WriteTotDeaths(cells []geom.Polygonal, deaths []float64, filename string) error {
+	type shpOut struct {
+		geom.Polygon
+		TotalPopD float64
+	}
+
+	e, err := shp.NewEncoder(filename, shpOut{})
+	if err != nil {
+		return &FileError{File: filename, Err: err}
+	}
+	for i, c := range cells {
+		err := e.Encode(shpOut{
+			Polygon:   c.Polygons()[0], // Assuming we are not using a multipolygon.
+			TotalPopD: deaths[i],
+		})
+		if err != nil {
+			e.Close()
+			return &FileError{File: filename, Row: i + 1, Err: err}
+		}
+	}
+	e.Close()
+	return nil
+}
+
+// WriteShapefile writes a shapefile with one float attribute per field. Field
+// names are limited to 10 characters.
+func WriteShapefile(cells []geom.Polygonal, fields []Field, filename string) error {
+	var shpFields []jshp.Field
+	for _, f := range fields {
+		if len(f.Name) > 10 {
+			return &FileError{File: filename, Field: f.Name, Err: errors.New("field name exceeds the 10 character shapefile limit")}
+		}
+		shpFields = append(shpFields, jshp.FloatField(f.Name, 24, 11))
+	}
+
+	// jonas-p/go-shp, unlike shp.Encoder, does not need a fixed struct
+	shape, err := jshp.Create(filename, jshp.POLYGON)
+	if err != nil {
+		return &FileError{File: filename, Err: err}
+	}
+	defer shape.Close()
+	if err := shape.SetFields(shpFields); err != nil {
+		return &FileError{File: filename, Err: err}
+	}
+
+	for i, c := range cells {
+		shape.Write(ShpPolygon(c))
+		for j, f := range fields {
+			if err := shape.WriteAttribute(i, j, f.Values[i]); err != nil {
+				return &FileError{File: filename, Row: i + 1, Field: f.Name, Err: err}
+			}
+		}
+	}
+	return nil
+}
+
+// ShpPolygon converts a geom.Polygonal to a jonas-p/go-shp Polygon,
+// keeping every ring of every polygon as a separate part
+func ShpPolygon(c geom.Polygonal) *jshp.Polygon {
+	var parts [][]jshp.Point
+	for _, poly := range c.Polygons() {
+		for _, ring := range poly {
+			var ringPoints []jshp.Point
+			for _, pt := range ring {
+				ringPoints = append(ringPoints, jshp.Point{X: pt.X, Y: pt.Y})
+			}
+			parts = append(parts, ringPoints)
+		}
+	}
+	polyLine := jshp.NewPolyLine(parts)
+	shpPoly := jshp.Polygon(*polyLine)
+	return &shpPoly
+}
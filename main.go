@@ -8,24 +8,127 @@ import (
     "strings"
     "flag"
     "encoding/json"
+    "errors"
     "io/ioutil"
-    "github.com/ctessum/geom/index/rtree"
 	"github.com/ctessum/geom"
-	"github.com/ctessum/geom/encoding/shp"
-    "github.com/fhs/go-netcdf/netcdf"
     "math"
+    "math/rand"
+    "sort"
+    "runtime"
+    "sync"
     "encoding/csv"
+    "time"
+
+    "mortality/aggregate"
+    "mortality/attribution"
+    "mortality/crf"
+    "mortality/crs"
+    "mortality/ioformats"
+    "mortality/regrid"
 )
 
 const (
-    pol         = "TotalPM25"
+    pol                 = "TotalPM25"
+    otherSource         = "Other" // Output field for deaths not attributed to a listed source
+    maxShapleySources   = 16
+    lifeTableWidth      = 5 // Years in each life-table age stratum but the last
+    countryNameColumn   = "iso3_r250_name" // Country names in the country GeoPackage
 )
 
 // OutputSpec defines what mortality outputs to generate
 type OutputSpec struct {
-    Mode   string   `json:"mode"`   // "allcause", "5cod", "individual", "multiple"
+    Mode   string   `json:"mode"`   // "allcause", "5cod", "individual", "multiple" or "lifetable"
     Causes []string `json:"causes"` // List of causes for individual/multiple mode
     Ages   []string `json:"ages"`   // List of ages for individual/multiple mode
+    Combined bool   `json:"combined"` // Write multiple/5cod results to one file with a field per cause/age (multiple) or cause (5cod)
+}
+
+// UncertaintySpec configures Monte Carlo propagation of input uncertainty
+type UncertaintySpec struct {
+    Iterations      int     `json:"iterations"`      // Number of Monte Carlo draws (0 = point estimate only)
+    Seed            int64   `json:"seed"`            // Random seed, so that draws are reproducible
+    MortalityRelSE  float64 `json:"mortalityRelSE"`  // Relative standard error of baseline mortality rates (0 = fixed)
+    PopulationRelSE float64 `json:"populationRelSE"` // Relative standard error of population (0 = fixed)
+}
+
+// Counterfactual is the counterfactual concentration (theoretical minimum risk
+// exposure level, μg/m³). In the config it is either a number or a [min, max]
+// range; a range is sampled uniformly in uncertainty runs and its midpoint is
+// used for point estimates.
+type Counterfactual struct {
+    Min float64
+    Max float64
+}
+
+func (c *Counterfactual) UnmarshalJSON(data []byte) error {
+    var v float64
+    if err := json.Unmarshal(data, &v); err == nil {
+        c.Min, c.Max = v, v
+        return nil
+    }
+    var r []float64
+    if err := json.Unmarshal(data, &r); err != nil || len(r) != 2 {
+        return fmt.Errorf("counterfactual must be a number or a [min, max] range, got %s", data)
+    }
+    c.Min, c.Max = r[0], r[1]
+    return nil
+}
+
+// point returns the counterfactual used for point estimates
+func (c Counterfactual) point() float64 {
+    return (c.Min + c.Max) / 2
+}
+
+// sample draws a counterfactual from the uniform range
+func (c Counterfactual) sample(rng *rand.Rand) float64 {
+    return c.Min + rng.Float64()*(c.Max-c.Min)
+}
+
+// HealthMetricsSpec configures conversion of attributable deaths to YLL, YLD and DALYs
+type HealthMetricsSpec struct {
+    LifeTableFile string `json:"lifeTableFile"` // CSV of age and remaining life expectancy (relative to dataDir); empty disables
+    YLDFile       string `json:"yldFile"`       // Optional CSV of cause and YLD per attributable death (relative to dataDir)
+}
+
+// ValuationSpec configures monetary valuation of attributable deaths using a
+// value of statistical life (VSL) transferred between countries by income
+type ValuationSpec struct {
+    VSL              float64 `json:"vsl"`              // VSL in the reference country (0 disables valuation)
+    ReferenceCountry string  `json:"referenceCountry"` // Country the VSL was estimated for, as named in incomeFile
+    IncomeElasticity float64 `json:"incomeElasticity"` // Income elasticity of the VSL
+    IncomeFile       string  `json:"incomeFile"`       // CSV of country and GDP per capita (relative to dataDir)
+    MappingFile      string  `json:"mappingFile"`      // InMAP cell to country mapping from the country aggregator
+    CountryFile      string  `json:"countryFile"`      // Country boundaries GeoPackage the mapping was created from
+}
+
+// CountryMappingSpec locates the InMAP cell to country mapping shared by the
+// country-level outputs
+type CountryMappingSpec struct {
+    MappingFile string `json:"mappingFile"` // Mapping CSV created by the country aggregator's create-mapping mode
+    CountryFile string `json:"countryFile"` // Country boundaries GeoPackage the mapping was created from
+}
+
+// ExposureSpec configures the population-weighted exposure summary
+type ExposureSpec struct {
+    File        string `json:"file"`        // Output CSV in outputDir ("" disables the summary)
+    MappingFile string `json:"mappingFile"` // InMAP cell to country mapping; without it only the global mean is reported
+    CountryFile string `json:"countryFile"` // Country boundaries GeoPackage the mapping was created from
+}
+
+// SourceSpec is one source contribution file for multi-source apportionment
+type SourceSpec struct {
+    Name       string `json:"name"`       // Output field name (10 characters or fewer)
+    File       string `json:"file"`       // PM2.5 contribution of the source (shapefile or NetCDF)
+    ShpVarName string `json:"shpVarName"` // Defaults to the top-level shpVarName
+    NCVarName  string `json:"ncVarName"`  // Defaults to the top-level ncVarName
+}
+
+// LifeTableSpec configures the multi-year life-table mode
+type LifeTableSpec struct {
+    StartYear  int      `json:"startYear"`  // Calendar year of the first trajectory file
+    Horizon    int      `json:"horizon"`    // Number of years to simulate; the last file is held constant after the trajectory ends
+    Trajectory []string `json:"trajectory"` // PM2.5 result files, one per year (shapefile or NetCDF)
+    Ages       []string `json:"ages"`       // All-cause age strata, 5 years apart except the last; required, as they depend on the baseline inputs available
 }
 
 // Config holds all configuration parameters
@@ -34,14 +137,35 @@ type Config struct {
     PopFile           string     `json:"popFile"`
     TotalPMFile       string     `json:"totalPMFile"`
     GEMMFile          string     `json:"gemmFile"`
+    CRF               string     `json:"crf"`     // "gemm", "ier", "loglinear" or "fusion"
+    CRFFile           string     `json:"crfFile"` // Parameter file for crf; defaults to gemmFile
+    Counterfactual    Counterfactual `json:"counterfactual"`
     ResultFile        string     `json:"resultFile"`
     OutputDir         string     `json:"outputDir"`
     OutputFile        string     `json:"outputFile"`
     ShpVarName        string     `json:"shpVarName"`
     NCVarName         string     `json:"ncVarName"`
     NCLayer           int        `json:"ncLayer"`
+    NCTime            int        `json:"ncTime"`
     OutputSpec        OutputSpec `json:"outputSpec"`
-    AttributionMethod string     `json:"attributionMethod"` // "proportional" or "zeroout"
+    AttributionMethod string     `json:"attributionMethod"` // "proportional", "zeroout" or "scenario"
+    BaselineFile      string     `json:"baselineFile"`      // Scenario method: baseline total PM2.5; defaults to totalPMFile
+    Uncertainty       UncertaintySpec `json:"uncertainty"`
+    HealthMetrics     HealthMetricsSpec `json:"healthMetrics"`
+    Valuation         ValuationSpec `json:"valuation"`
+    Sources           []SourceSpec `json:"sources"`       // Source contributions apportioned together instead of resultFile
+    Decomposition     string       `json:"decomposition"` // "" or "shapley" (zero-out only)
+    LifeTable         LifeTableSpec `json:"lifeTable"`
+    Exposure          ExposureSpec `json:"exposure"`
+    CountryMapping    CountryMappingSpec `json:"countryMapping"` // Default mapping for valuation, exposure and country outputs
+    SummaryFile       string       `json:"summaryFile"`  // CSV in outputDir of results by country, cause and age ("" disables it)
+    OutputFormat      string       `json:"outputFormat"` // "shapefile", "netcdf" or "gpkg"
+    NCOutputGrid      string       `json:"ncOutputGrid"` // NetCDF output grid: "inmap" or "input" (the resultFile lat/lon grid)
+    GridMismatch      string       `json:"gridMismatch"` // Cell inputs not on the totalPMFile grid: "regrid" or "error"
+    CacheDir          string       `json:"cacheDir"`     // Directory for decoded and regridded cell inputs ("" disables the cache)
+    AreaWeighting     string       `json:"areaWeighting"` // How cells are measured for regridding: "planar" or "spherical"
+    Year              int          `json:"year"`     // Projection year for population and baseline mortality (0 = base year)
+    Scenario          string       `json:"scenario"` // Projection scenario, e.g. "SSP2"
 }
 
 // Default configuration values
@@ -51,18 +175,32 @@ func defaultConfig() Config {
         PopFile:           "inputs/pop.shp",
         TotalPMFile:       "inputs/totalpm.shp",
         GEMMFile:          "inputs/gemm_params.csv",
+        CRF:               "gemm",
+        Counterfactual:    Counterfactual{Min: 2.4, Max: 2.4},
         ResultFile:        "/Users/sumilthakrar/UMN/Projects/GlobalAg/cropnh3/results/nh3manure/inmap_output.shp",
         OutputDir:         "output/",
         OutputFile:        "output.shp",
         ShpVarName:        "TotalPM25",
         NCVarName:         "IJ_AVG_S__NH4",
         NCLayer:           0,
+        NCTime:            0,
         AttributionMethod: "proportional",
+        OutputFormat:      "shapefile",
+        NCOutputGrid:      "inmap",
+        GridMismatch:      "regrid",
+        AreaWeighting:     "planar",
         OutputSpec: OutputSpec{
             Mode:   "allcause",
             Causes: []string{},
             Ages:   []string{},
         },
+        Uncertainty: UncertaintySpec{
+            Iterations: 0,
+            Seed:       1,
+        },
+        Valuation: ValuationSpec{
+            IncomeElasticity: 1.0,
+        },
     }
 }
 
@@ -71,16 +209,39 @@ var (
     resultFile        = flag.String("resultFile", "", "Path to the PM2.5 result file (shapefile or NetCDF)")
     outputDir         = flag.String("outputDir", "", "Directory to save output files")
     outputFile        = flag.String("outputFile", "", "Name of the output shapefile")
+    outputFormat      = flag.String("outputFormat", "", "Output format: shapefile, netcdf or gpkg")
+    summaryFile       = flag.String("summaryFile", "", "CSV in outputDir of results by country, cause and age")
     shpVarName        = flag.String("shpVarName", "", "Shapefile variable/field name to read")
     ncVarName         = flag.String("ncVarName", "", "NetCDF variable name to read")
     ncLayer           = flag.Int("ncLayer", -1, "Vertical layer index to extract from NetCDF (0 = ground level)")
+    ncTime            = flag.Int("ncTime", -1, "Time index to extract from NetCDF (0 = first)")
     dataDir           = flag.String("dataDir", "", "Path to data directory containing inputs")
-    attributionMethod = flag.String("attributionMethod", "", "Attribution method: proportional or zeroout")
+    attributionMethod = flag.String("attributionMethod", "", "Attribution method: proportional, zeroout or scenario")
+    baselineFile      = flag.String("baselineFile", "", "Baseline total PM2.5 file for the scenario method (shapefile or NetCDF)")
+    crfName           = flag.String("crf", "", "Concentration-response function: gemm, ier, loglinear or fusion")
+    crfFile           = flag.String("crfFile", "", "Parameter file for the concentration-response function (relative to dataDir)")
+    counterfactual    = flag.String("counterfactual", "", "Counterfactual concentration in μg/m³, either a value (2.4) or a range (2.4,5.9)")
+    iterations        = flag.Int("iterations", -1, "Number of Monte Carlo iterations for uncertainty analysis (0 = point estimate only)")
+    seed              = flag.Int64("seed", -1, "Random seed for Monte Carlo uncertainty analysis")
+    year              = flag.Int("year", -1, "Projection year for population and baseline mortality (0 = base year)")
+    scenario          = flag.String("scenario", "", "Projection scenario for population and baseline mortality, e.g. SSP2")
+    errorSummary      = flag.String("errorSummary", "", errorSummaryUsage)
+    gridMismatch      = flag.String("gridMismatch", "", "Cell inputs not on the totalPMFile grid: regrid or error")
+    cacheDir          = flag.String("cacheDir", "", "Directory for decoded and regridded cell inputs, reused by later runs")
+    areaWeighting     = flag.String("areaWeighting", "", "How cells are measured for regridding: planar or spherical (for longitude/latitude grids)")
+    validate          = flag.Bool("validate", false, "Check that the inputs exist and match the InMAP grid, without calculating anything")
 )
 
-// loadConfig loads configuration from file and applies command-line overrides
-func loadConfig() Config {
-    flag.Parse()
+func init() {
+    flag.BoolVar(validate, "dry-run", false, "Same as -validate")
+}
+
+// loadConfig loads configuration from file and applies command-line overrides.
+// Invalid settings are returned as a configError.
+func loadConfig(args []string) (Config, error) {
+    if err := flag.CommandLine.Parse(args); err != nil {
+        return Config{}, configError{err: err}
+    }
 
     // Start with defaults
     config := defaultConfig()
@@ -89,9 +250,17 @@ func loadConfig() Config {
     if *configFile != "" {
         fmt.Printf("Loading configuration from %s\n", *configFile)
         data, err := ioutil.ReadFile(*configFile)
-        check(err)
-        err = json.Unmarshal(data, &config)
-        check(err)
+        if err != nil {
+            return config, configError{err: err}
+        }
+        if err := json.Unmarshal(data, &config); err != nil {
+            fe := &ioformats.FileError{File: *configFile, Err: err}
+            var te *json.UnmarshalTypeError
+            if errors.As(err, &te) {
+                fe.Field = te.Field
+            }
+            return config, configError{err: fe}
+        }
     }
 
     // Override with command-line flags (if provided)
@@ -104,6 +273,12 @@ func loadConfig() Config {
     if *outputFile != "" {
         config.OutputFile = *outputFile
     }
+    if *outputFormat != "" {
+        config.OutputFormat = *outputFormat
+    }
+    if *summaryFile != "" {
+        config.SummaryFile = *summaryFile
+    }
     if *shpVarName != "" {
         config.ShpVarName = *shpVarName
     }
@@ -113,118 +288,697 @@ func loadConfig() Config {
     if *ncLayer != -1 {
         config.NCLayer = *ncLayer
     }
+    if *ncTime != -1 {
+        config.NCTime = *ncTime
+    }
     if *dataDir != "" {
         config.DataDir = *dataDir
     }
     if *attributionMethod != "" {
         config.AttributionMethod = *attributionMethod
     }
+    if *baselineFile != "" {
+        config.BaselineFile = *baselineFile
+    }
+    if *crfName != "" {
+        config.CRF = *crfName
+    }
+    if *crfFile != "" {
+        config.CRFFile = *crfFile
+    }
+    if *counterfactual != "" {
+        cf := *counterfactual
+        if strings.Contains(cf, ",") {
+            cf = "[" + cf + "]"
+        }
+        if err := json.Unmarshal([]byte(cf), &config.Counterfactual); err != nil {
+            return config, configErrorf("counterfactual", "-counterfactual: %v", err)
+        }
+    }
+    if *iterations != -1 {
+        config.Uncertainty.Iterations = *iterations
+    }
+    if *seed != -1 {
+        config.Uncertainty.Seed = *seed
+    }
+    if *year != -1 {
+        config.Year = *year
+    }
+    if *scenario != "" {
+        config.Scenario = *scenario
+    }
+    if *gridMismatch != "" {
+        config.GridMismatch = *gridMismatch
+    }
+    if *cacheDir != "" {
+        config.CacheDir = *cacheDir
+    }
+    if *areaWeighting != "" {
+        config.AreaWeighting = *areaWeighting
+    }
 
     // Validate attribution method
-    if config.AttributionMethod != "proportional" && config.AttributionMethod != "zeroout" {
-        panic(fmt.Sprintf("Invalid attributionMethod: %s. Must be 'proportional' or 'zeroout'", config.AttributionMethod))
+    if config.AttributionMethod != "proportional" && config.AttributionMethod != "zeroout" && config.AttributionMethod != "scenario" {
+        return config, configErrorf("attributionMethod", "Invalid attributionMethod: %s. Must be 'proportional', 'zeroout' or 'scenario'", config.AttributionMethod)
+    }
+    if config.CRF != "gemm" && config.CRF != "ier" && config.CRF != "loglinear" && config.CRF != "fusion" {
+        return config, configErrorf("crf", "Invalid crf: %s. Must be 'gemm', 'ier', 'loglinear' or 'fusion'", config.CRF)
+    }
+    if config.Counterfactual.Min < 0 || config.Counterfactual.Min > config.Counterfactual.Max {
+        return config, configErrorf("counterfactual", "Invalid counterfactual range: [%g, %g]", config.Counterfactual.Min, config.Counterfactual.Max)
+    }
+    if len(config.Sources) > 0 {
+        if err := validateSources(&config); err != nil {
+            return config, err
+        }
+    } else if config.Decomposition != "" {
+        return config, configErrorf("decomposition", "decomposition requires sources")
+    }
+    if config.OutputSpec.Mode == "lifetable" {
+        if len(config.LifeTable.Trajectory) == 0 || len(config.LifeTable.Ages) == 0 {
+            return config, configErrorf("lifeTable", "lifetable mode requires lifeTable.trajectory and lifeTable.ages")
+        }
+        if err := checkLifeTableAges(config.LifeTable.Ages); err != nil {
+            return config, err
+        }
+        if config.LifeTable.Horizon < len(config.LifeTable.Trajectory) {
+            config.LifeTable.Horizon = len(config.LifeTable.Trajectory)
+        }
+        if len(config.Sources) > 0 || config.Uncertainty.Iterations > 0 || config.AttributionMethod == "scenario" {
+            return config, configErrorf("outputSpec.mode", "lifetable mode cannot be combined with sources, uncertainty or the scenario attribution method")
+        }
+    }
+    if (config.Year == 0) != (config.Scenario == "") {
+        return config, configErrorf("year", "year and scenario must be set together")
+    }
+    if config.Year != 0 {
+        dir := projectedPath(config, "")
+        if _, err := os.Stat(dir); err != nil {
+            return config, configErrorf("scenario", "No projection data for scenario %s in %d: %v", config.Scenario, config.Year, err)
+        }
+    }
+    if config.OutputFormat != "shapefile" && config.OutputFormat != "netcdf" && config.OutputFormat != "gpkg" {
+        return config, configErrorf("outputFormat", "Invalid outputFormat: %s. Must be 'shapefile', 'netcdf' or 'gpkg'", config.OutputFormat)
+    }
+    // The shared country mapping applies wherever a mapping isn't given explicitly
+    if (config.CountryMapping.MappingFile == "") != (config.CountryMapping.CountryFile == "") {
+        return config, configErrorf("countryMapping", "countryMapping.mappingFile and countryMapping.countryFile must be set together")
+    }
+    if config.Valuation.MappingFile == "" && config.Valuation.CountryFile == "" {
+        config.Valuation.MappingFile = config.CountryMapping.MappingFile
+        config.Valuation.CountryFile = config.CountryMapping.CountryFile
+    }
+    if config.Exposure.MappingFile == "" && config.Exposure.CountryFile == "" {
+        config.Exposure.MappingFile = config.CountryMapping.MappingFile
+        config.Exposure.CountryFile = config.CountryMapping.CountryFile
+    }
+    if config.NCOutputGrid != "inmap" && config.NCOutputGrid != "input" {
+        return config, configErrorf("ncOutputGrid", "Invalid ncOutputGrid: %s. Must be 'inmap' or 'input'", config.NCOutputGrid)
+    }
+    if config.GridMismatch != "regrid" && config.GridMismatch != "error" {
+        return config, configErrorf("gridMismatch", "Invalid gridMismatch: %s. Must be 'regrid' or 'error'", config.GridMismatch)
+    }
+    if config.AreaWeighting != "planar" && config.AreaWeighting != "spherical" {
+        return config, configErrorf("areaWeighting", "Invalid areaWeighting: %s. Must be 'planar' or 'spherical'", config.AreaWeighting)
+    }
+    if config.SummaryFile != "" {
+        if config.CountryMapping.MappingFile == "" {
+            return config, configErrorf("summaryFile", "summaryFile requires countryMapping")
+        }
+        if len(config.Sources) > 0 || config.Uncertainty.Iterations > 0 || config.OutputSpec.Mode == "lifetable" {
+            return config, configErrorf("summaryFile", "summaryFile cannot be combined with sources, uncertainty iterations or the lifetable mode")
+        }
+    }
+    if config.OutputSpec.Combined {
+        if config.OutputSpec.Mode != "multiple" && config.OutputSpec.Mode != "5cod" {
+            return config, configErrorf("outputSpec.combined", "outputSpec.combined is only supported in the multiple and 5cod modes")
+        }
+        if len(config.Sources) > 0 || config.Uncertainty.Iterations > 0 {
+            return config, configErrorf("outputSpec.combined", "outputSpec.combined cannot be combined with sources or uncertainty iterations")
+        }
+    }
+    if config.Exposure.File != "" {
+        if config.OutputSpec.Mode == "lifetable" {
+            return config, configErrorf("exposure", "exposure cannot be combined with the lifetable output mode")
+        }
+        if (config.Exposure.MappingFile == "") != (config.Exposure.CountryFile == "") {
+            return config, configErrorf("exposure", "exposure.mappingFile and exposure.countryFile must be set together")
+        }
+    }
+    if config.Uncertainty.Iterations < 0 {
+        return config, configErrorf("uncertainty.iterations", "Invalid uncertainty iterations: %d. Must be 0 or greater", config.Uncertainty.Iterations)
+    }
+    if config.HealthMetrics.YLDFile != "" && config.HealthMetrics.LifeTableFile == "" {
+        return config, configErrorf("healthMetrics.yldFile", "healthMetrics.yldFile requires healthMetrics.lifeTableFile")
+    }
+    if config.HealthMetrics.LifeTableFile != "" && config.Uncertainty.Iterations > 0 {
+        return config, configErrorf("healthMetrics", "healthMetrics cannot be combined with uncertainty iterations")
+    }
+    if config.Valuation.VSL > 0 {
+        if config.Valuation.ReferenceCountry == "" || config.Valuation.IncomeFile == "" ||
+            config.Valuation.MappingFile == "" || config.Valuation.CountryFile == "" {
+            return config, configErrorf("valuation", "valuation requires referenceCountry, incomeFile, mappingFile and countryFile")
+        }
+        if config.Uncertainty.Iterations > 0 {
+            return config, configErrorf("valuation", "valuation cannot be combined with uncertainty iterations")
+        }
     }
 
-    return config
+    return config, nil
+}
+
+// validateSources checks the multi-source settings and fills in default variable names
+func validateSources(config *Config) error {
+    if config.Decomposition != "" && config.Decomposition != "shapley" {
+        return configErrorf("decomposition", "Invalid decomposition: %s. Must be '' or 'shapley'", config.Decomposition)
+    }
+    if config.Decomposition == "shapley" {
+        if config.AttributionMethod != "zeroout" {
+            return configErrorf("decomposition", "shapley decomposition requires the zeroout attribution method")
+        }
+        if len(config.Sources) > maxShapleySources {
+            return configErrorf("decomposition", "shapley decomposition supports at most %d sources", maxShapleySources)
+        }
+    }
+    if config.Uncertainty.Iterations > 0 || config.HealthMetrics.LifeTableFile != "" || config.Valuation.VSL > 0 {
+        return configErrorf("sources", "sources cannot be combined with uncertainty, healthMetrics or valuation")
+    }
+    if config.AttributionMethod == "scenario" {
+        return configErrorf("sources", "sources cannot be used with the scenario attribution method")
+    }
+    seen := make(map[string]bool)
+    for i := range config.Sources {
+        src := &config.Sources[i]
+        if src.Name == "" || len(src.Name) > 10 || src.Name == otherSource {
+            return configErrorf("sources", "Invalid source name %q: must be 1-10 characters and not %q", src.Name, otherSource)
+        }
+        if seen[src.Name] {
+            return configErrorf("sources", "Duplicate source name: %s", src.Name)
+        }
+        seen[src.Name] = true
+        if src.ShpVarName == "" {
+            src.ShpVarName = config.ShpVarName
+        }
+        if src.NCVarName == "" {
+            src.NCVarName = config.NCVarName
+        }
+    }
+    return nil
 }
 
 func main(){
-    config := loadConfig()
+    // Flag errors are returned so they get the same exit status and summary as other errors
+    flag.CommandLine.Init(os.Args[0], flag.ContinueOnError)
+
+    // Without a subcommand, the flags are for run, as before subcommands existed
+    args := os.Args[1:]
+    cmd := "run"
+    if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+        cmd, args = args[0], args[1:]
+    }
+    var err error
+    switch cmd {
+    case "run":
+        err = run(args)
+    case "batch":
+        err = runBatch(args)
+    case "aggregate":
+        err = runAggregate(args)
+    case "areas":
+        err = runAreas(args)
+    case "mapping":
+        if len(args) > 0 {
+            cmd += " " + args[0]
+        }
+        err = runMapping(args)
+    default:
+        usage()
+        err = configErrorf("", "unknown subcommand '%s'", cmd)
+    }
+    os.Exit(exitStatus(cmd, err))
+}
+
+// usage lists the subcommands
+func usage() {
+    fmt.Println(`Usage:
+  aqhealth [run] [flags]          Calculate attributable mortality (see aqhealth run -h)
+  aqhealth batch [flags] files... Run the configuration for each result file, sharing the other inputs
+  aqhealth aggregate [flags]      Sum per-cell results to countries by intersecting the geometries
+  aqhealth mapping create [flags] Compute and save the InMAP cell to country mapping
+  aqhealth mapping apply [flags]  Sum per-cell results to countries with a saved mapping
+  aqhealth areas [flags]          Compare totals regridded with planar and spherical areas`)
+}
+
+// run calculates attributable mortality for the configuration given by args
+func run(args []string) error {
+    config, err := loadConfig(args)
+    if err != nil {
+        return err
+    }
+    if flag.NArg() > 0 {
+        return configErrorf("", "unexpected arguments %v; use the batch subcommand to run several result files", flag.Args())
+    }
+    if *manifest != "" {
+        return configErrorf("", "-manifest is only used by the batch subcommand")
+    }
+    if err := checkOutputGrid(config); err != nil {
+        return err
+    }
+    if *validate {
+        return validateInputs(config)
+    }
 
     // Create output directory if it doesn't exist
     if err := os.MkdirAll(config.OutputDir, 0755); err != nil {
-        check(err)
+        return err
     }
 
     fmt.Println("reading inputs")
+    if config.Year != 0 {
+        fmt.Printf("Using %s %d projections of population and baseline mortality\n", config.Scenario, config.Year)
+    }
+    if config.OutputSpec.Mode == "lifetable" {
+        inmapCells, totpm, err := ioformats.ReadShapefile(filepath.Join(config.DataDir, config.TotalPMFile), "TotalPM25")
+        if err != nil {
+            return err
+        }
+        return runLifeTable(inmapCells, totpm, config)
+    }
+    in, err := loadSharedInputs(config)
+    if err != nil {
+        return err
+    }
+    _, err = runScenario(in, config)
+    return err
+}
+
+// checkOutputGrid checks that a NetCDF output on the input grid has a NetCDF
+// resultFile to take the grid from
+func checkOutputGrid(config Config) error {
+    if config.NCOutputGrid == "input" && config.OutputFormat == "netcdf" {
+        if len(config.Sources) > 0 || config.OutputSpec.Mode == "lifetable" || !strings.HasSuffix(strings.ToLower(config.ResultFile), ".nc") {
+            return configErrorf("ncOutputGrid", "ncOutputGrid 'input' requires a NetCDF resultFile, and cannot be used with sources or the lifetable mode")
+        }
+    }
+    return nil
+}
+
+// sharedInputs are the inputs that do not depend on the result file. They are
+// read once and shared by every scenario of a batch.
+type sharedInputs struct {
+    inmapCells  []geom.Polygonal
+    totpm       []float64
+    population  []float64
+    gemmAllVals []crf.Entry
+    metrics     *metricTables
+    cellVSL     []float64
+    baselines   *baselineStore
+}
+
+// loadSharedInputs reads the InMAP grid and total PM2.5, population,
+// concentration-response parameters, health metric tables and cell VSLs.
+// Baseline inputs for each cause/age are read when they are first needed,
+// through the same store as population.
+func loadSharedInputs(config Config) (*sharedInputs, error) {
+    in := &sharedInputs{}
+    var err error
 // Getting file paths
-    inmapCells, totpm           := getTots(filepath.Join(config.DataDir, config.TotalPMFile), "TotalPM25")
+    in.inmapCells, in.totpm, err    = ioformats.ReadShapefile(filepath.Join(config.DataDir, config.TotalPMFile), "TotalPM25")
+    if err != nil {
+        return nil, err
+    }
+    gridCRS, err                    := readGridCRS(config)
+    if err != nil {
+        return nil, err
+    }
+    in.baselines                    = newBaselineStore(in.inmapCells, gridCRS, config)
+    in.population, err              = in.baselines.cellData(projectedPath(config, config.PopFile), "TotalPop", true)
+    if err != nil {
+        return nil, err
+    }
+
+    // Process concentration-response params
+    if in.gemmAllVals, err = readCRF(config); err != nil {
+        return nil, err
+    }
+    if in.metrics, err = loadMetricTables(config); err != nil {
+        return nil, err
+    }
+    if config.Valuation.VSL > 0 {
+        fmt.Println("Computing value of statistical life per cell")
+        if in.cellVSL, err = getCellVSL(len(in.inmapCells), config); err != nil {
+            return nil, err
+        }
+    }
+    return in, nil
+}
+
+// outputTotal is the sum over all cells of one field of an output file
+type outputTotal struct {
+    file  string
+    field string
+    total float64
+}
 
-    // Determine if input is NetCDF or shapefile based on extension
+// runScenario calculates attributable mortality for the result or source
+// files in config, using the shared inputs, and writes its outputs to
+// config.OutputDir. It returns the total of each output field.
+func runScenario(in *sharedInputs, config Config) ([]outputTotal, error) {
+    var err error
+    inmapCells, totpm, population := in.inmapCells, in.totpm, in.population
+    var resultpm []float64
+    var sourcepm [][]float64
+    if len(config.Sources) > 0 {
+        for _, src := range config.Sources {
+            fmt.Printf("Reading source %s...\n", src.Name)
+            pm, err := readResult(src.File, src.ShpVarName, src.NCVarName, config.NCLayer, config.NCTime, in.baselines)
+            if err != nil {
+                return nil, fmt.Errorf("source %s: %w", src.Name, err)
+            }
+            sourcepm = append(sourcepm, pm)
+        }
+    } else {
+        resultpm, err = readResult(config.ResultFile, config.ShpVarName, config.NCVarName, config.NCLayer, config.NCTime, in.baselines)
+        if err != nil {
+            return nil, err
+        }
+    }
+    if config.AttributionMethod == "scenario" && config.BaselineFile != "" {
+        // The scenario method uses totpm as the baseline and resultpm as the policy field
+        fmt.Println("Reading scenario baseline...")
+        totpm, err = readResult(config.BaselineFile, config.ShpVarName, config.NCVarName, config.NCLayer, config.NCTime, in.baselines)
+        if err != nil {
+            return nil, err
+        }
+    }
+    if config.Exposure.File != "" {
+        fmt.Println("Computing population-weighted exposure")
+        conc := []ioformats.Field{{Name: "totpm", Values: totpm}}
+        if len(config.Sources) > 0 {
+            for i, src := range config.Sources {
+                conc = append(conc, ioformats.Field{Name: src.Name, Values: sourcepm[i]})
+            }
+        } else {
+            conc = append(conc, ioformats.Field{Name: "resultpm", Values: resultpm})
+        }
+        if err := writeExposure(population, conc, config); err != nil {
+            return nil, err
+        }
+    }
+
+    var summary *countrySummary
+    if config.SummaryFile != "" {
+        if summary, err = newCountrySummary(len(inmapCells), config); err != nil {
+            return nil, err
+        }
+    }
+
+    // Generate outputs based on outputSpec mode
+    groups, err := outputGroups(config, in.gemmAllVals)
+    if err != nil {
+        return nil, err
+    }
+    if in.metrics != nil {
+        if err := checkAgeResolved(groups, in.gemmAllVals); err != nil {
+            return nil, err
+        }
+    }
+    var totals []outputTotal
+    for _, og := range groups {
+        var fields []ioformats.Field
+        switch {
+        case config.Uncertainty.Iterations > 0:
+            // Draws must be summed across causes within each iteration, so all keys are handled together
+            stats, err := getDeathsMC(og.keys, in.baselines, resultpm, totpm, population, in.gemmAllVals, config)
+            if err != nil {
+                return nil, err
+            }
+            fields = uncertaintyFields(stats)
+        case len(config.Sources) > 0:
+            fields, err = getSourceDeaths(og.keys, in.baselines, sourcepm, totpm, population, in.gemmAllVals, config)
+            if err != nil {
+                return nil, err
+            }
+        default:
+            attrib, h, breakdown, err := getGroupDeaths(og, in.baselines, resultpm, totpm, population, in.gemmAllVals, in.metrics, summary, config)
+            if err != nil {
+                return nil, err
+            }
+            fields = append(deathFields(attrib, h, in.cellVSL), breakdown...)
+        }
+        fmt.Println("writing total deaths to file")
+        if err := writeOutput(inmapCells, fields, og.filename, config); err != nil {
+            return nil, err
+        }
+        for _, f := range fields {
+            t := outputTotal{file: og.filename, field: f.Name}
+            for _, v := range f.Values {
+                if !math.IsNaN(v) && !math.IsInf(v, 0) {
+                    t.total += v
+                }
+            }
+            totals = append(totals, t)
+        }
+    }
+    if summary != nil {
+        return totals, summary.write(filepath.Join(config.OutputDir, config.SummaryFile))
+    }
+    return totals, nil
+}
+
+// readResult reads a PM2.5 result file, as NetCDF or shapefile depending on
+// its extension, and regrids it onto the InMAP cells unless it is already on
+// the InMAP grid. The regridding weights are shared through inputs, so files
+// on the same grid are only intersected with the InMAP cells once. Cells with
+// no value (NetCDF fill values) are left out of the regridding, and how many
+// there are is printed.
+func readResult(file, shpVarName, ncVarName string, ncLayer, ncTime int, inputs *baselineStore) ([]float64, error) {
     var oldCells []geom.Polygonal
     var resultpmgrid []float64
+    var err error
 
-    if strings.HasSuffix(strings.ToLower(config.ResultFile), ".nc") {
+    if strings.HasSuffix(strings.ToLower(file), ".nc") {
         fmt.Println("Reading NetCDF input file...")
-        oldCells, resultpmgrid = getNCData(config.ResultFile, config.NCVarName, config.NCLayer)
+        oldCells, resultpmgrid, err = ioformats.ReadNetCDF(file, ncVarName, ncLayer, ncTime)
     } else {
         fmt.Println("Reading shapefile input...")
-        oldCells, resultpmgrid = getTots(config.ResultFile, config.ShpVarName)
+        oldCells, resultpmgrid, err = ioformats.ReadShapefile(file, shpVarName)
         // Normally it's this one, but I've changed it for ASEAN
-//        oldCells, resultpmgrid = getShpData(config.ResultFile, config.ShpVarName)
+//        oldCells, resultpmgrid = getShpData(file, shpVarName)
+    }
+    if err != nil {
+        return nil, err
+    }
+    if missing := countNaN(resultpmgrid); missing > 0 {
+        fmt.Printf("%d of %d cells of %s have no value (fill or missing values) and are left out\n", missing, len(resultpmgrid), file)
+    }
+    fileCRS, err                := ioformats.ReadCRS(file)
+    if err != nil {
+        return nil, err
+    }
+    if oldCells, err = reproject(oldCells, fileCRS, inputs.gridCRS, file); err != nil {
+        return nil, err
+    }
+    resultpm := resultpmgrid
+    if regrid.Compare(oldCells, inputs.inmapCells) != nil {
+        if resultpm, err = inputs.weights(oldCells).Mean(resultpmgrid); err != nil {
+            return nil, fmt.Errorf("regridding %s: %w", file, err)
+        }
+    }
+    if missing := countNaN(resultpm); missing > 0 {
+        fmt.Printf("%d InMAP cells are outside %s or only overlap its cells with no value; their attributable deaths are NaN and are left out of totals\n", missing, file)
     }
-    resultpm, err               := regridMean(oldCells, inmapCells, resultpmgrid)
-    check(err)
-    _, population               := getShpData(filepath.Join(config.DataDir, config.PopFile), "TotalPop")
+    return resultpm, nil
+}
 
-    // Process GEMM params
-    f, err                      := os.Open(filepath.Join(config.DataDir, config.GEMMFile))
-    check(err)
-    defer f.Close()
-    csvReader                   := csv.NewReader(f)
-    gemmData, err               := csvReader.ReadAll()
-    check(err)
-    gemmAllVals                 := processGEMM(gemmData)
+// countNaN returns the number of NaN values
+func countNaN(values []float64) int {
+    n := 0
+    for _, v := range values {
+        if math.IsNaN(v) {
+            n++
+        }
+    }
+    return n
+}
 
-    // Generate outputs based on outputSpec mode
+// outputGroup is one output file and the cause/age combinations summed into it
+type outputGroup struct {
+    filename string
+    keys     []crf.Key
+    columns  []string // Output field for each key, written alongside the total; nil for the total only
+}
+
+// outputGroups lists the output files requested by the outputSpec mode
+func outputGroups(config Config, gemmAllVals []crf.Entry) ([]outputGroup, error) {
+    outputPath := filepath.Join(config.OutputDir, config.OutputFile)
     switch config.OutputSpec.Mode {
     case "allcause":
         fmt.Println("Calculating all-cause mortality for adults 25+")
-        attrib := getDeaths("all", "25", resultpm, totpm, population, gemmAllVals, config)
-        writeTotDeaths(inmapCells, attrib, filepath.Join(config.OutputDir, config.OutputFile))
+        return []outputGroup{{outputPath, []crf.Key{{Cause: "all", Age: "25"}}, nil}}, nil
 
     case "5cod":
         fmt.Println("Calculating 5 causes of death (summed across all ages)")
-        get5COD(gemmAllVals, inmapCells, resultpm, totpm, population, config)
+        var keys []crf.Key
+        for _, c := range gemmAllVals {
+//      Baseline mortality rates aren't saved out for IHD and STR for people aged 25+
+//        if ((c.Key.Cause == "all") || (c.Key.Cause == "str") || (c.Key.Cause == "ihd"))  && (c.Key.Age == "25") {
+//      Also, we do not want to sum allcause when calculating 5-COD.
+            if (c.Key.Cause == "all") {
+//            if (c.Key.Cause != "ihd") {
+                continue
+            }
+            keys = append(keys, c.Key)
+        }
+        if config.OutputSpec.Combined {
+            // One field per cause, summed across ages
+            columns := make([]string, len(keys))
+            for i, k := range keys {
+                columns[i] = k.Cause
+            }
+            if err := checkColumns(columns, config); err != nil {
+                return nil, err
+            }
+            return []outputGroup{{outputPath, keys, columns}}, nil
+        }
+        return []outputGroup{{outputPath, keys, nil}}, nil
 
     case "individual":
         if len(config.OutputSpec.Causes) != 1 || len(config.OutputSpec.Ages) != 1 {
-            panic("individual mode requires exactly one cause and one age")
+            return nil, configErrorf("outputSpec", "individual mode requires exactly one cause and one age")
         }
         cause := config.OutputSpec.Causes[0]
         age := config.OutputSpec.Ages[0]
         fmt.Printf("Calculating mortality for cause=%s, age=%s\n", cause, age)
-        attrib := getDeaths(cause, age, resultpm, totpm, population, gemmAllVals, config)
-        writeTotDeaths(inmapCells, attrib, filepath.Join(config.OutputDir, config.OutputFile))
+        return []outputGroup{{outputPath, []crf.Key{{Cause: cause, Age: age}}, nil}}, nil
 
     case "multiple":
         if len(config.OutputSpec.Causes) == 0 || len(config.OutputSpec.Ages) == 0 {
-            panic("multiple mode requires at least one cause and one age")
+            return nil, configErrorf("outputSpec", "multiple mode requires at least one cause and one age")
         }
         fmt.Printf("Calculating mortality for %d cause(s) x %d age(s) = %d outputs\n",
             len(config.OutputSpec.Causes), len(config.OutputSpec.Ages),
             len(config.OutputSpec.Causes)*len(config.OutputSpec.Ages))
 
+        if config.OutputSpec.Combined {
+            var keys []crf.Key
+            var columns []string
+            for _, cause := range config.OutputSpec.Causes {
+                for _, age := range config.OutputSpec.Ages {
+                    keys = append(keys, crf.Key{Cause: cause, Age: age})
+                    columns = append(columns, cause+"_"+strings.Replace(age, ".", "", -1))
+                }
+            }
+            if err := checkColumns(columns, config); err != nil {
+                return nil, err
+            }
+            return []outputGroup{{outputPath, keys, columns}}, nil
+        }
+
+        var groups []outputGroup
         for _, cause := range config.OutputSpec.Causes {
             for _, age := range config.OutputSpec.Ages {
-                fmt.Printf("  Processing: %s_%s\n", cause, age)
-                attrib := getDeaths(cause, age, resultpm, totpm, population, gemmAllVals, config)
                 outputName := fmt.Sprintf("%s_%s.shp", cause, age)
-                writeTotDeaths(inmapCells, attrib, filepath.Join(config.OutputDir, outputName))
+                groups = append(groups, outputGroup{filepath.Join(config.OutputDir, outputName), []crf.Key{{Cause: cause, Age: age}}, nil})
             }
         }
+        return groups, nil
 
     default:
-        panic(fmt.Sprintf("Unknown output mode: %s. Valid modes: allcause, 5cod, individual, multiple", config.OutputSpec.Mode))
+        return nil, configErrorf("outputSpec.mode", "Unknown output mode: %s. Valid modes: allcause, 5cod, individual, multiple, lifetable", config.OutputSpec.Mode)
     }
 }
 
-func get5COD (gemmAllVals []gemmAll, inmapCells []geom.Polygonal, resultpm, totpm, population []float64, config Config) {
-    totAttrib := make([]float64, len(inmapCells))
-    for _, c := range gemmAllVals {
-//      Baseline mortality rates aren't saved out for IHD and STR for people aged 25+
-//        if ((c.gk.cod == "all") || (c.gk.cod == "str") || (c.gk.cod == "ihd"))  && (c.gk.age == "25") {
-//      Also, we do not want to sum allcause when calculating 5-COD.
-        if (c.gk.cod == "all") {
-//        if (c.gk.cod != "ihd") {
-            continue
+// checkColumns returns an error if a combined output field name is too long
+// for a shapefile
+func checkColumns(columns []string, config Config) error {
+    if config.OutputFormat != "shapefile" {
+        return nil
+    }
+    for _, c := range columns {
+        if len(c) > 10 {
+            return configErrorf("outputSpec.combined", "combined output field %s is longer than 10 characters", c)
+        }
+    }
+    return nil
+}
+
+// checkAgeResolved returns an error if a group includes a cause whose
+// concentration-response parameters have a single age. YLL are taken from
+// the life expectancy at the age of each group, which for the 5-year GEMM
+// groups is mid-group (e.g. 27.5 for 25-29). A single age group (e.g. "25"
+// for all adults) spans many ages of death, and its age is a lower bound.
+func checkAgeResolved(groups []outputGroup, entries []crf.Entry) error {
+    nAges := make(map[string]int)
+    for _, e := range entries {
+        nAges[e.Key.Cause]++
+    }
+    for _, og := range groups {
+        for _, k := range og.keys {
+            if nAges[k.Cause] < 2 {
+                return configErrorf("healthMetrics", "healthMetrics need age-resolved cause/age groups, but cause=%s only has parameters for age %s, which covers all adults", k.Cause, k.Age)
+            }
+        }
+    }
+    return nil
+}
+
+// getGroupDeaths sums attributable deaths over the cause/age combinations in
+// og, along with their health metrics if metrics is not nil. If og has
+// columns, the deaths are also summed per column and returned as fields in
+// the order the columns first appear. Each cause/age is added to summary if
+// it is not nil.
+func getGroupDeaths(og outputGroup, baselines *baselineStore, resultpm, totpm, population []float64, gemmAllVals []crf.Entry, metrics *metricTables, summary *countrySummary, config Config) ([]float64, *healthOutput, []ioformats.Field, error) {
+    totAttrib := make([]float64, len(totpm))
+    totMetrics := newHealthOutput(len(totpm))
+    var breakdown []ioformats.Field
+    column := make(map[string]int)
+    for i, k := range og.keys {
+        fmt.Printf("  Processing: %s_%s\n", k.Cause, k.Age)
+        sl, err     := getDeaths(k.Cause, k.Age, baselines, resultpm, totpm, population, gemmAllVals, summary, config)
+        if err != nil {
+            return nil, nil, nil, err
         }
-        fmt.Println(c.gk.cod, c.gk.age)
-        sl          := getDeaths(c.gk.cod, c.gk.age, resultpm, totpm, population, gemmAllVals, config)
         totAttrib   = sumSlices(sl,totAttrib)
+        if metrics != nil {
+            // YLL depend on age, so they are summed per cause/age rather than from totAttrib
+            h, err := metrics.compute(sl, k.Cause, k.Age)
+            if err != nil {
+                return nil, nil, nil, err
+            }
+            totMetrics = totMetrics.add(h)
+        }
+        if og.columns != nil {
+            j, ok := column[og.columns[i]]
+            if !ok {
+                j = len(breakdown)
+                column[og.columns[i]] = j
+                breakdown = append(breakdown, ioformats.Field{Name: og.columns[i], Values: make([]float64, len(totpm))})
+            }
+            breakdown[j].Values = sumSlices(sl, breakdown[j].Values)
+        }
+    }
+    if metrics == nil {
+        return totAttrib, nil, breakdown, nil
+    }
+    return totAttrib, &totMetrics, breakdown, nil
+}
+
+// deathFields lists the output fields for attributable deaths, including health
+// metrics if h is not nil and monetary damages if cellVSL is not nil
+func deathFields(deaths []float64, h *healthOutput, cellVSL []float64) []ioformats.Field {
+    fields := []ioformats.Field{{Name: "TotalPopD", Values: deaths}}
+    if h != nil {
+        fields = append(fields, ioformats.Field{Name: "YLL", Values: h.yll}, ioformats.Field{Name: "YLD", Values: h.yld}, ioformats.Field{Name: "DALY", Values: h.daly})
+    }
+    if cellVSL != nil {
+        damages := make([]float64, len(deaths))
+        for i, d := range deaths {
+            damages[i] = d * cellVSL[i]
+        }
+        fields = append(fields, ioformats.Field{Name: "Damages", Values: damages})
     }
-    fmt.Println("writing total deaths to file")
-    writeTotDeaths(inmapCells, totAttrib, filepath.Join(config.OutputDir, config.OutputFile))
+    return fields
 }
 
 func sumSlices(x, y []float64) ([]float64) {
@@ -235,392 +989,1169 @@ func sumSlices(x, y []float64) ([]float64) {
     return z
 }
 
-type gemmParams struct {
-    θ   float64
-    α   float64
-    μ   float64
-    v   float64
+// readCRF reads the concentration-response parameters for the function
+// selected by config.CRF. Errors in the table name the column by its header.
+func readCRF(config Config) ([]crf.Entry, error) {
+    path := crfPath(config)
+    records, err := ioformats.ReadCSV(path)
+    if err != nil {
+        return nil, err
+    }
+    entries, err := crf.Parse(config.CRF, records)
+    var re *crf.RowError
+    if errors.As(err, &re) {
+        fe := &ioformats.FileError{File: path, Row: re.Row, Err: re.Err}
+        if re.Column > 0 && re.Column <= len(records[0]) {
+            fe.Field = records[0][re.Column-1]
+        } else if re.Column > 0 {
+            fe.Field = fmt.Sprintf("column %d", re.Column)
+        }
+        return nil, fe
+    } else if err != nil {
+        return nil, &ioformats.FileError{File: path, Err: err}
+    }
+    crf.WithCounterfactual(entries, config.Counterfactual.point())
+    return entries, nil
 }
 
-type gemmKey struct {
-    cod string
-    age string
+// crfPath returns the path of the concentration-response parameter file
+func crfPath(config Config) string {
+    file := config.CRFFile
+    if file == "" {
+        file = config.GEMMFile
+    }
+    return filepath.Join(config.DataDir, file)
 }
 
-type gemmAll struct {
-    gp  gemmParams
-    gk  gemmKey
-    se  string
+// lifeTable holds remaining life expectancy by age from a reference life table
+type lifeTable struct {
+    ages       []float64 // Ascending
+    expectancy []float64
 }
 
-func processGEMM(data [][]string) []gemmAll {
-    var gpAll []gemmAll
-    var err error
-    for i, line := range data {
-        if i > 0 { // omit header line
-            var rec gemmAll
-            for j, field := range line {
-                if j == 0 {
-                    rec.gk.cod = field
-                } else if j == 1 {
-                    rec.gk.age = field
-                } else if j == 2 {
-                    rec.gp.θ, err  = strconv.ParseFloat(field,64)
-                    check(err)
-                } else if j == 3 {
-                    rec.se = field
-                } else if j == 4 {
-                    rec.gp.α, err = strconv.ParseFloat(field,64)
-                    check(err)
-                } else if j == 5 {
-                    rec.gp.μ, err = strconv.ParseFloat(field,64)
-                    check(err)
-                } else if j == 6 {
-                    rec.gp.v, err = strconv.ParseFloat(field,64)
-                    check(err)
-                }
+// metricTables holds the reference tables used to convert deaths to YLL, YLD and DALYs
+type metricTables struct {
+    lifeTable lifeTable
+    yldRatios map[string]float64 // YLD per attributable death, by cause
+}
+
+// healthOutput holds attributable deaths and the derived health metrics per cell
+type healthOutput struct {
+    deaths []float64
+    yll    []float64
+    yld    []float64
+    daly   []float64
+}
+
+// loadMetricTables reads the life table and YLD ratios named in the config,
+// returning nil if health metrics are not configured
+func loadMetricTables(config Config) (*metricTables, error) {
+    if config.HealthMetrics.LifeTableFile == "" {
+        return nil, nil
+    }
+    mt := &metricTables{yldRatios: make(map[string]float64)}
+    file := filepath.Join(config.DataDir, config.HealthMetrics.LifeTableFile)
+    lines, err := readTable(file, 2)
+    if err != nil {
+        return nil, err
+    }
+    for i := range lines {
+        if i == 0 { // omit header line
+            continue
+        }
+        age, err := parseCell(file, lines, i, 0)
+        if err != nil {
+            return nil, err
+        }
+        le, err := parseCell(file, lines, i, 1)
+        if err != nil {
+            return nil, err
+        }
+        if len(mt.lifeTable.ages) > 0 && age <= mt.lifeTable.ages[len(mt.lifeTable.ages)-1] {
+            return nil, &ioformats.FileError{File: file, Row: i + 1, Field: lines[0][0],
+                Err: fmt.Errorf("life table ages must be in ascending order: %g follows %g", age, mt.lifeTable.ages[len(mt.lifeTable.ages)-1])}
+        }
+        mt.lifeTable.ages = append(mt.lifeTable.ages, age)
+        mt.lifeTable.expectancy = append(mt.lifeTable.expectancy, le)
+    }
+    if len(mt.lifeTable.ages) == 0 {
+        return nil, &ioformats.FileError{File: file, Err: errors.New("life table has no rows")}
+    }
+    if config.HealthMetrics.YLDFile != "" {
+        file := filepath.Join(config.DataDir, config.HealthMetrics.YLDFile)
+        lines, err := readTable(file, 2)
+        if err != nil {
+            return nil, err
+        }
+        for i, line := range lines {
+            if i == 0 { // omit header line
+                continue
+            }
+            ratio, err := parseCell(file, lines, i, 1)
+            if err != nil {
+                return nil, err
             }
-            gpAll = append(gpAll, rec)
+            mt.yldRatios[line[0]] = ratio
         }
     }
-    return gpAll
+    return mt, nil
 }
 
-func saveTotalDeaths(cause, age string, resultpm, totpm, population []float64, g []gemmAll, inmapCells []geom.Polygonal, config Config) {
-    var demogFile, acmortFile, ijhatFile string
-    var params gemmParams
-    m := make(map[gemmKey]gemmParams)
-    for _, line := range g {
-        m[line.gk] = line.gp
+// readTable reads a CSV file with a header row and at least nColumns columns
+func readTable(filename string, nColumns int) ([][]string, error) {
+    lines, err := ioformats.ReadCSV(filename)
+    if err != nil {
+        return nil, err
     }
-    params                  = m[gemmKey{cause,age}]
-    demogFile               = filepath.Join(config.DataDir, "inputs","age"+age+".shp")
-    acmortFile              = filepath.Join(config.DataDir, "basemorts",cause+age+".shp")
-    ijhatFile               = filepath.Join(config.DataDir, "ijhats",cause+"_"+age+".shp")
+    if len(lines) > 0 && len(lines[0]) < nColumns {
+        return nil, &ioformats.FileError{File: filename, Row: 1, Err: fmt.Errorf("expected %d columns, got %d", nColumns, len(lines[0]))}
+    }
+    return lines, nil
+}
 
-    _, countryRegrid            := getTots(demogFile, "RRs")    // Change name
-    _, allcausemort             := getTots(acmortFile, "RRs")   // Change name
-    _, ijhat                    := getTots(ijhatFile, "RRs")    // Change name
-    totdeaths                   := totDeaths(totpm, resultpm, population, ijhat, countryRegrid, allcausemort, params)
-    writeTotDeaths(inmapCells, totdeaths, "deaths-totals.shp")
+// parseCell parses column j of row i of a table read by readTable as a
+// float, naming the column by its header in any error
+func parseCell(filename string, lines [][]string, i, j int) (float64, error) {
+    v, err := strconv.ParseFloat(strings.TrimSpace(lines[i][j]), 64)
+    if err != nil {
+        return 0, &ioformats.FileError{File: filename, Row: i + 1, Field: lines[0][j], Err: err}
+    }
+    return v, nil
 }
 
-func getDeaths(cause, age string, resultpm, totpm, population []float64, g []gemmAll, config Config) []float64 {
-    var demogFile, acmortFile, ijhatFile string
-    var params gemmParams
-    m := make(map[gemmKey]gemmParams)
-    for _, line := range g {
-        m[line.gk] = line.gp
+// lookup returns the remaining life expectancy at age, interpolating linearly
+// between life table rows and holding the end values constant beyond them
+func (lt lifeTable) lookup(age float64) float64 {
+    n := len(lt.ages)
+    if age <= lt.ages[0] {
+        return lt.expectancy[0]
     }
-    params                  = m[gemmKey{cause,age}]
-    demogFile               = filepath.Join(config.DataDir, "inputs","age"+age+".shp")
-    acmortFile              = filepath.Join(config.DataDir, "basemorts",cause+age+".shp")
-    ijhatFile               = filepath.Join(config.DataDir, "ijhats", cause+"_"+age+".shp")
+    if age >= lt.ages[n-1] {
+        return lt.expectancy[n-1]
+    }
+    i := sort.SearchFloat64s(lt.ages, age)
+    if lt.ages[i] == age {
+        return lt.expectancy[i]
+    }
+    frac := (age - lt.ages[i-1]) / (lt.ages[i] - lt.ages[i-1])
+    return lt.expectancy[i-1] + frac*(lt.expectancy[i]-lt.expectancy[i-1])
+}
 
-    _, countryRegrid            := getTots(demogFile, "RRs")    // Change name
-    _, allcausemort             := getTots(acmortFile, "RRs")   // Change name
-    _, ijhat                    := getTots(ijhatFile, "RRs")    // Change name
-
-    // Route to appropriate attribution method
-    var attrib []float64
-    if config.AttributionMethod == "zeroout" {
-        // Zero-out methodology: deaths = totalDeaths(totpm+resultpm) - baseDeaths(totpm)
-        totdeaths := totDeathsSum(totpm, resultpm, population, ijhat, countryRegrid, allcausemort, params)
-        baseline := baseDeaths(totpm, population, ijhat, countryRegrid, allcausemort, params)
-        attrib = zeroOut(totdeaths, baseline)
-    } else {
-        // Proportional attribution (default): deaths = resultpm * totdeaths / totpm
-        totdeaths := totDeaths(totpm, resultpm, population, ijhat, countryRegrid, allcausemort, params)
-        attrib = attribution(totpm, totdeaths, resultpm)
-    }
-
-    return attrib
-}
-
-func getNCData(ncFile, varName string, layer int) ([]geom.Polygonal, []float64) {
-	ds, err := netcdf.OpenFile(ncFile, netcdf.NOWRITE)
-	check(err)
-	defer ds.Close()
-
-	// Get dimensions
-	latVar, err := ds.Var("lat")
-	check(err)
-	lats64, err := latVar.Len()
-	check(err)
-	lats := int(lats64)
-	lat := make([]float32, lats)
-	check(latVar.ReadFloat32s(lat))
-	dy := lat[5] - lat[4] // Assume regular grid, first grid cell may be weird.
-
-	lonVar, err := ds.Var("lon")
-	check(err)
-	lons64, err := lonVar.Len()
-	check(err)
-	lons := int(lons64)
-	lon := make([]float32, lons)
-	check(lonVar.ReadFloat32s(lon))
-	dx := lon[5] - lon[4] // Assume regular grid, first grid cell may be weird.
-
-	// Read the variable
-	v, err := ds.Var(varName)
-	check(err)
-
-	// Check if variable is 2D or 3D by checking number of dimensions
-	ndims, err := v.NAttrs()
-	check(err)
-
-	var ncData []float64
-
-	// For 3D data (lev, lat, lon), extract single layer at ground level
-	// We read a slice at the specified layer index
-	if layer >= 0 {
-		// 3D data - read single layer slice
-		ncData = make([]float64, lats*lons)
-		// ReadFloat64Slice expects (data, start indices, count)
-		check(v.ReadFloat64Slice(ncData, []uint64{uint64(layer), 0, 0}, []uint64{1, uint64(lats), uint64(lons)}))
-	} else {
-		// This shouldn't happen with default layer=0, but kept for safety
-		panic(fmt.Sprintf("Invalid layer index: %d", layer))
-	}
+// compute converts attributable deaths for a cause/age to YLL, YLD and DALYs.
+// YLL = deaths × remaining life expectancy at age, the age label of the group
+// taken as the age at death; YLD = deaths × YLD per death for the cause.
+func (mt *metricTables) compute(deaths []float64, cause, age string) (healthOutput, error) {
+    a, err := strconv.ParseFloat(age, 64)
+    if err != nil {
+        return healthOutput{}, fmt.Errorf("age %s of cause %s: %v", age, cause, err)
+    }
+    le := mt.lifeTable.lookup(a)
+    ratio := mt.yldRatios[cause]
+    h := newHealthOutput(len(deaths))
+    for i, d := range deaths {
+        h.deaths[i] = d
+        h.yll[i] = d * le
+        h.yld[i] = d * ratio
+        h.daly[i] = h.yll[i] + h.yld[i]
+    }
+    return h, nil
+}
 
-	// Create grid cells
-	gcCells := make([]geom.Polygonal, 0, len(ncData))
-	for j := 0; j < lats; j++ {
-		for i := 0; i < lons; i++ {
-			gcCells = append(gcCells, &geom.Bounds{
-				Min: geom.Point{X: float64(lon[i] - dx/2), Y: float64(lat[j] - dy/2)},
-				Max: geom.Point{X: float64(lon[i] + dx/2), Y: float64(lat[j] + dy/2)},
-			})
-		}
-	}
+func newHealthOutput(n int) healthOutput {
+    return healthOutput{
+        deaths: make([]float64, n),
+        yll:    make([]float64, n),
+        yld:    make([]float64, n),
+        daly:   make([]float64, n),
+    }
+}
 
-	gcVals := make([]float64, len(ncData))
-	for i, v := range ncData {
-		gcVals[i] = float64(v)
-	}
+// add returns the cell-by-cell sum of h and o
+func (h healthOutput) add(o healthOutput) healthOutput {
+    return healthOutput{
+        deaths: sumSlices(h.deaths, o.deaths),
+        yll:    sumSlices(h.yll, o.yll),
+        yld:    sumSlices(h.yld, o.yld),
+        daly:   sumSlices(h.daly, o.daly),
+    }
+}
 
-	// Suppress unused variable warning
-	_ = ndims
+// getCellVSL calculates the value of statistical life in each InMAP cell.
+// The reference VSL is transferred to each country as
+// VSL_c = VSL_ref × (GDP_c / GDP_ref)^elasticity, and cells spanning several
+// countries get the area-weighted mean of their countries' VSLs. Cells outside
+// every country are given a VSL of zero.
+func getCellVSL(nCells int, config Config) ([]float64, error) {
+    v := config.Valuation
+    income := make(map[string]float64)
+    incomeFile := filepath.Join(config.DataDir, v.IncomeFile)
+    lines, err := readTable(incomeFile, 2)
+    if err != nil {
+        return nil, err
+    }
+    for i, line := range lines {
+        if i == 0 { // omit header line
+            continue
+        }
+        gdp, err := parseCell(incomeFile, lines, i, 1)
+        if err != nil {
+            return nil, err
+        }
+        income[line[0]] = gdp
+    }
+    refIncome, ok := income[v.ReferenceCountry]
+    if !ok {
+        return nil, &ioformats.FileError{File: incomeFile, Err: fmt.Errorf("reference country %s not found", v.ReferenceCountry)}
+    }
+
+    names, mapping, err := loadCountryMapping(v.MappingFile, v.CountryFile, nCells)
+    if err != nil {
+        return nil, err
+    }
 
-	return gcCells, gcVals
+    weighted := make([]float64, nCells)
+    coverage := make([]float64, nCells)
+    for _, r := range mapping {
+        name := names[r.CountryIndex]
+        gdp, ok := income[name]
+        if !ok {
+            return nil, &ioformats.FileError{File: incomeFile, Err: fmt.Errorf("country %s not found", name)}
+        }
+        countryVSL := v.VSL * math.Pow(gdp/refIncome, v.IncomeElasticity)
+        weighted[r.InmapCellIndex] += countryVSL * r.Fraction
+        coverage[r.InmapCellIndex] += r.Fraction
+    }
+    for i := range weighted {
+        if coverage[i] > 0 {
+            weighted[i] /= coverage[i]
+        }
+    }
+    return weighted, nil
 }
 
+// writeExposure writes the population-weighted mean of each concentration
+// field to a CSV, for the whole grid and, if a country mapping is configured,
+// for each country. Cells shared between countries contribute to each in
+// proportion to the mapped fraction. Cells where a field is missing are left
+// out of its mean, but not of the population column. Countries without
+// population are omitted.
+func writeExposure(population []float64, conc []ioformats.Field, config Config) error {
+    type region struct {
+        name string
+        pop  float64
+        sums []float64
+        pops []float64 // population of the cells with a value of each field
+    }
+    newRegion := func(name string) region {
+        return region{name: name, sums: make([]float64, len(conc)), pops: make([]float64, len(conc))}
+    }
+    addCell := func(r *region, c int, p float64) {
+        r.pop += p
+        for j, f := range conc {
+            if v := f.Values[c]; !math.IsNaN(v) && !math.IsInf(v, 0) {
+                r.sums[j] += p * v
+                r.pops[j] += p
+            }
+        }
+    }
+    global := newRegion("Global")
+    for c, p := range population {
+        addCell(&global, c, p)
+    }
+    regions := []region{global}
 
-// totDeathsSum calculates total deaths with sum of concentrations (totpm + resultpm)
-// Includes robust NaN and Inf handling for zero-out methodology
-func totDeathsSum(totpm, resultpm, population, ijhat, countryRegrid, allcausemort []float64, params gemmParams) (deaths []float64) {
-    for t := range totpm {
-        var concs float64
-        if math.IsNaN(totpm[t]) {
-            if math.IsNaN(resultpm[t]) {
-                concs = 0.0
-            } else {
-                concs = resultpm[t] + totpm[t]
+    if config.Exposure.MappingFile != "" {
+        names, mapping, err := loadCountryMapping(config.Exposure.MappingFile, config.Exposure.CountryFile, len(population))
+        if err != nil {
+            return err
+        }
+        countries := make([]region, len(names))
+        for i, name := range names {
+            countries[i] = newRegion(name)
+        }
+        for _, r := range mapping {
+            addCell(&countries[r.CountryIndex], r.InmapCellIndex, population[r.InmapCellIndex]*r.Fraction)
+        }
+        for _, c := range countries {
+            if c.pop > 0 {
+                regions = append(regions, c)
             }
-        } else {
-            if math.IsNaN(resultpm[t]) {
-                concs = resultpm[t] + totpm[t]
-            } else {
-                concs = resultpm[t] + totpm[t]
+        }
+    }
+
+    filename := filepath.Join(config.OutputDir, config.Exposure.File)
+    header := []string{"region", "population"}
+    for _, c := range conc {
+        header = append(header, c.Name)
+    }
+    rows := [][]string{header}
+    for _, r := range regions {
+        row := []string{r.name, strconv.FormatFloat(r.pop, 'g', -1, 64)}
+        for j, s := range r.sums {
+            if r.pops[j] == 0 {
+                // No population with a concentration in this column
+                row = append(row, "")
+                continue
             }
+            row = append(row, strconv.FormatFloat(s/r.pops[j], 'g', -1, 64))
         }
-        var dd float64
-        if ijhat[t] == 0 || math.IsNaN(ijhat[t]) || math.IsNaN(allcausemort[t]) || math.IsNaN(countryRegrid[t]) {
-            dd = 0.0
-        } else {
-            dd = (GEMM(concs, params.θ, params.α, params.μ, params.v) - 1) *
-                 (population[t] / ijhat[t]) * countryRegrid[t] * allcausemort[t] / 100000
-            if math.IsNaN(dd) || math.IsInf(dd, 0) {
-                dd = 0.0
+        rows = append(rows, row)
+    }
+    if err := writeCSV(filename, rows); err != nil {
+        return err
+    }
+
+    for j, c := range conc {
+        if global.pops[j] == 0 {
+            fmt.Printf("  Global population-weighted %s: no populated cells with a concentration\n", c.Name)
+            continue
+        }
+        fmt.Printf("  Global population-weighted %s: %g μg/m³\n", c.Name, global.sums[j]/global.pops[j])
+    }
+    fmt.Printf("Exposure summary written to %s\n", filename)
+    return nil
+}
+
+// writeCSV writes records to a new CSV file
+func writeCSV(filename string, records [][]string) error {
+    f, err := os.Create(filename)
+    if err != nil {
+        return err
+    }
+    defer f.Close()
+    if err := csv.NewWriter(f).WriteAll(records); err != nil {
+        return &ioformats.FileError{File: filename, Err: err}
+    }
+    return f.Close()
+}
+
+// loadCountryMapping reads a cell-to-country mapping created by the mapping
+// create subcommand and the country names from the GeoPackage it was created
+// from, in fid order to match the country indices of the mapping. It returns
+// an error if the mapping does not fit an nCells grid and the countries.
+func loadCountryMapping(mappingFile, countryFile string, nCells int) ([]string, []aggregate.MappingRecord, error) {
+    names, err := ioformats.ReadGeoPackageNames(countryFile, countryNameColumn)
+    if err != nil {
+        return nil, nil, err
+    }
+    mapping, err := aggregate.LoadMapping(mappingFile)
+    if err != nil {
+        return nil, nil, err
+    }
+    if err := aggregate.Check(mapping, nCells, len(names)); err != nil {
+        return nil, nil, &ioformats.FileError{File: mappingFile,
+            Err: fmt.Errorf("does not match the InMAP grid and %s: %v", countryFile, err)}
+    }
+    return names, mapping, nil
+}
+
+func saveTotalDeaths(cause, age string, resultpm, totpm, population []float64, g []crf.Entry, inmapCells []geom.Polygonal, config Config) error {
+    params, err             := crf.Lookup(g, cause, age)
+    if err != nil {
+        return err
+    }
+    demogFile               := filepath.Join(config.DataDir, "inputs","age"+age+".shp")
+    acmortFile              := filepath.Join(config.DataDir, "basemorts",cause+age+".shp")
+    ijhatFile               := filepath.Join(config.DataDir, "ijhats",cause+"_"+age+".shp")
+
+    _, countryRegrid, err       := ioformats.ReadShapefile(demogFile, "RRs")    // Change name
+    if err != nil {
+        return err
+    }
+    _, allcausemort, err        := ioformats.ReadShapefile(acmortFile, "RRs")   // Change name
+    if err != nil {
+        return err
+    }
+    _, ijhat, err               := ioformats.ReadShapefile(ijhatFile, "RRs")    // Change name
+    if err != nil {
+        return err
+    }
+    totdeaths                   := attribution.TotDeaths(totpm, resultpm, population, ijhat, countryRegrid, allcausemort, params)
+    return ioformats.WriteTotDeaths(inmapCells, totdeaths, "deaths-totals.shp")
+}
+
+func getDeaths(cause, age string, baselines *baselineStore, resultpm, totpm, population []float64, g []crf.Entry, summary *countrySummary, config Config) ([]float64, error) {
+    params, err             := crf.Lookup(g, cause, age)
+    if err != nil {
+        return nil, err
+    }
+    countryRegrid, allcausemort, ijhat, err := baselines.get(cause, age)
+    if err != nil {
+        return nil, err
+    }
+
+    attrib, err := attribution.Attribute(config.AttributionMethod, totpm, resultpm, population, ijhat, countryRegrid, allcausemort, params)
+    if err != nil {
+        return nil, err
+    }
+
+    if summary != nil {
+        summary.add(cause, age, attrib, totpm, resultpm, population, countryRegrid, allcausemort)
+    }
+    return attrib, nil
+}
+
+// countrySummary accumulates results by country, cause and age for the
+// summaryFile table
+type countrySummary struct {
+    names   []string
+    mapping []aggregate.MappingRecord
+    rows    [][]string
+}
+
+// newCountrySummary loads the country mapping for a summary of an nCells grid
+func newCountrySummary(nCells int, config Config) (*countrySummary, error) {
+    names, mapping, err := loadCountryMapping(config.CountryMapping.MappingFile, config.CountryMapping.CountryFile, nCells)
+    if err != nil {
+        return nil, err
+    }
+    return &countrySummary{names: names, mapping: mapping}, nil
+}
+
+// add sums one cause/age to the whole grid ("Global") and to each country:
+// the population in the age group, its population-weighted mean totpm and
+// resultpm, its baseline deaths (population times the baseline mortality
+// rate), and the deaths attributable to resultpm. Cells with a missing
+// concentration are left out of its mean, which is left empty if no
+// populated cell has one, other missing values count as zero, and countries
+// with neither population nor deaths are left out.
+func (s *countrySummary) add(cause, age string, attrib, totpm, resultpm, population, countryRegrid, allcausemort []float64) {
+    orZero := func(x float64) float64 {
+        if math.IsNaN(x) || math.IsInf(x, 0) {
+            return 0
+        }
+        return x
+    }
+    type totals struct {
+        pop, totpm, resultpm, baseline, attrib float64
+        totpmPop, resultpmPop                  float64 // population with each concentration
+    }
+    regions := make([]totals, len(s.names)+1) // Global, then countries
+    addCell := func(r *totals, c int, frac float64) {
+        pop := orZero(population[c] * countryRegrid[c]) * frac
+        r.pop += pop
+        if !math.IsNaN(totpm[c]) && !math.IsInf(totpm[c], 0) {
+            r.totpm += pop * totpm[c]
+            r.totpmPop += pop
+        }
+        if !math.IsNaN(resultpm[c]) && !math.IsInf(resultpm[c], 0) {
+            r.resultpm += pop * resultpm[c]
+            r.resultpmPop += pop
+        }
+        r.baseline += pop * orZero(allcausemort[c]) / 100000
+        r.attrib += orZero(attrib[c]) * frac
+    }
+    for c := range attrib {
+        addCell(&regions[0], c, 1)
+    }
+    for _, m := range s.mapping {
+        addCell(&regions[m.CountryIndex+1], m.InmapCellIndex, m.Fraction)
+    }
+
+    format := func(x float64) string { return strconv.FormatFloat(x, 'g', -1, 64) }
+    mean := func(sum, pop float64) string {
+        if pop == 0 {
+            return "" // No population with a concentration
+        }
+        return format(sum / pop)
+    }
+    for i, r := range regions {
+        name := "Global"
+        if i > 0 {
+            name = s.names[i-1]
+        }
+        if i > 0 && r.pop == 0 && r.attrib == 0 {
+            continue
+        }
+        s.rows = append(s.rows, []string{name, cause, age, format(r.pop),
+            mean(r.totpm, r.totpmPop), mean(r.resultpm, r.resultpmPop), format(r.baseline), format(r.attrib)})
+    }
+}
+
+// write saves the summary as CSV
+func (s *countrySummary) write(filename string) error {
+    header := []string{"region", "cause", "age", "population", "totpm", "resultpm", "baseline_deaths", "attributable_deaths"}
+    if err := writeCSV(filename, append([][]string{header}, s.rows...)); err != nil {
+        return err
+    }
+    fmt.Printf("Summary by country, cause and age written to %s\n", filename)
+    return nil
+}
+
+// getSourceDeaths apportions deaths among several sources, summed over the
+// cause/age combinations in keys. As for a single resultFile, totpm includes
+// the sources for the proportional method, and excludes them for zero-out,
+// which adds them to it. The returned fields, one per source plus "Other",
+// sum to the deaths in each cell:
+//   - proportional: deaths(totpm) are split by each source's share of totpm,
+//     with sources scaled down where together they exceed totpm;
+//   - zeroout: each source gets deaths(totpm + sources) minus the deaths
+//     without it, and "Other" gets the remainder of deaths(totpm + sources),
+//     including the non-additive interaction;
+//   - zeroout with shapley decomposition: the deaths above the background
+//     totpm are split by Shapley values, and "Other" gets the background
+//     deaths.
+func getSourceDeaths(keys []crf.Key, baselines *baselineStore, sourcepm [][]float64, totpm, population []float64, g []crf.Entry, config Config) ([]ioformats.Field, error) {
+    nSrc := len(sourcepm)
+    out := make([][]float64, nSrc+1)
+    for i := range out {
+        out[i] = make([]float64, len(totpm))
+    }
+    weights := attribution.ShapleyWeights(nSrc)
+    for _, k := range keys {
+        fmt.Printf("  Processing: %s_%s\n", k.Cause, k.Age)
+        params, err := crf.Lookup(g, k.Cause, k.Age)
+        if err != nil {
+            return nil, err
+        }
+        countryRegrid, allcausemort, ijhat, err := baselines.get(k.Cause, k.Age)
+        if err != nil {
+            return nil, err
+        }
+        srcs := make([]float64, nSrc)
+        for t := range totpm {
+            missing := math.IsNaN(totpm[t])
+            for s := range sourcepm {
+                srcs[s] = sourcepm[s][t]
+                missing = missing || math.IsNaN(srcs[s])
+            }
+            if missing {
+                for s := range out {
+                    out[s][t] = math.NaN()
+                }
+                continue
+            }
+            deaths := func(concs float64) float64 {
+                return attribution.CellDeathsSafe(concs, population[t], ijhat[t], countryRegrid[t], allcausemort[t], params)
+            }
+            var shares []float64
+            switch {
+            case config.AttributionMethod != "zeroout":
+                totdeaths := attribution.CellDeaths(totpm[t], population[t], ijhat[t], countryRegrid[t], allcausemort[t], params)
+                shares = attribution.ProportionalShares(totpm[t], totdeaths, srcs)
+            case config.Decomposition == "shapley":
+                shares = attribution.ShapleyShares(totpm[t], srcs, weights, deaths)
+            default:
+                shares = attribution.ZeroOutShares(totpm[t], srcs, deaths)
+            }
+            for s, v := range shares {
+                out[s][t] += v
             }
         }
-        deaths = append(deaths, dd)
     }
-    return deaths
+    fields := make([]ioformats.Field, 0, nSrc+1)
+    for s, src := range config.Sources {
+        fields = append(fields, ioformats.Field{Name: src.Name, Values: out[s]})
+    }
+    return append(fields, ioformats.Field{Name: otherSource, Values: out[nSrc]}), nil
 }
 
-// baseDeaths calculates baseline deaths using only totpm (no resultpm)
-// Used for zero-out methodology to establish baseline scenario
-func baseDeaths(totpm, population, ijhat, countryRegrid, allcausemort []float64, params gemmParams) (deaths []float64) {
-    for t := range totpm {
-        var concs float64
-        if math.IsNaN(totpm[t]) {
-            concs = 0.0
-        } else {
-            concs = totpm[t]
+// lifeTableGroup holds the inputs for one all-cause age stratum of the life table
+type lifeTableGroup struct {
+    params        crf.Function
+    width         float64 // Years; 0 for the open-ended last group
+    countryRegrid []float64
+    allcausemort  []float64
+    ijhat         []float64
+}
+
+// runLifeTable projects deaths avoided and life-years gained over
+// config.LifeTable.Horizon years if the source in the trajectory files were
+// removed. Each cell's adult population is followed through annual steps in
+// two cohorts: a baseline with the all-cause mortality rates from basemorts,
+// and a policy cohort whose rates are reduced by the deaths attributable to
+// that year's concentrations. Survivors age into the next stratum at
+// 1/width per year, and the youngest stratum receives a constant inflow equal
+// to its initial size divided by its width.
+func runLifeTable(inmapCells []geom.Polygonal, totpm []float64, config Config) error {
+    lt := config.LifeTable
+    fmt.Printf("Calculating life-table impacts over %d years\n", lt.Horizon)
+
+    gridCRS, err := readGridCRS(config)
+    if err != nil {
+        return err
+    }
+    baselines := newBaselineStore(inmapCells, gridCRS, config)
+    var trajectory [][]float64
+    for y, file := range lt.Trajectory {
+        fmt.Printf("Reading exposure for %d...\n", lt.StartYear+y)
+        pm, err := readResult(file, config.ShpVarName, config.NCVarName, config.NCLayer, config.NCTime, baselines)
+        if err != nil {
+            return err
         }
-        var dd float64
-        if ijhat[t] == 0 || math.IsNaN(ijhat[t]) || math.IsNaN(allcausemort[t]) || math.IsNaN(countryRegrid[t]) {
-            dd = 0.0
-        } else {
-            dd = (GEMM(concs, params.θ, params.α, params.μ, params.v) - 1) *
-                 (population[t] / ijhat[t]) * countryRegrid[t] * allcausemort[t] / 100000
-            if math.IsNaN(dd) || math.IsInf(dd, 0) {
-                dd = 0.0
+        trajectory = append(trajectory, pm)
+    }
+    population, err := baselines.cellData(projectedPath(config, config.PopFile), "TotalPop", true)
+    if err != nil {
+        return err
+    }
+    gemmAllVals, err := readCRF(config)
+    if err != nil {
+        return err
+    }
+    params, err := lifeTableParams(gemmAllVals, lt.Ages)
+    if err != nil {
+        return err
+    }
+
+    groups := make([]lifeTableGroup, len(lt.Ages))
+    for g, age := range lt.Ages {
+        fmt.Printf("  Loading baseline inputs: all_%s\n", age)
+        groups[g].params = params[g]
+        if g < len(lt.Ages)-1 {
+            groups[g].width = lifeTableWidth
+        }
+        groups[g].countryRegrid, groups[g].allcausemort, groups[g].ijhat, err = baselines.get("all", age)
+        if err != nil {
+            return err
+        }
+    }
+
+    nCells := len(totpm)
+    deathsAvoided := make([]float64, nCells)
+    lifeYears := make([]float64, nCells)
+    annualDeaths := make([]float64, lt.Horizon)
+    annualLifeYears := make([]float64, lt.Horizon)
+
+    base := make([]float64, len(groups))
+    policy := make([]float64, len(groups))
+    for t := 0; t < nCells; t++ {
+        if lifeTableMissing(totpm[t], trajectory, t) {
+            // Left out of the annual totals
+            deathsAvoided[t], lifeYears[t] = math.NaN(), math.NaN()
+            continue
+        }
+        for g := range groups {
+            base[g] = population[t] * groups[g].countryRegrid[t]
+            if math.IsNaN(base[g]) {
+                base[g] = 0
             }
+            policy[g] = base[g]
+        }
+        inflow := 0.0
+        if groups[0].width > 0 {
+            inflow = base[0] / groups[0].width
+        }
+        for y := 0; y < lt.Horizon; y++ {
+            resultpm := trajectory[len(trajectory)-1]
+            if y < len(trajectory) {
+                resultpm = trajectory[y]
+            }
+            var dBase, dPolicy float64
+            for g, grp := range groups {
+                rate := grp.allcausemort[t] / 100000
+                if math.IsNaN(rate) || rate < 0 {
+                    rate = 0
+                }
+                // Attributable deaths per person in this stratum
+                attrib := attribution.Cell(config.AttributionMethod, totpm[t], resultpm[t], 1,
+                    grp.ijhat[t], 1, grp.allcausemort[t], grp.params)
+                dBase += stepCohort(base, g, rate)
+                dPolicy += stepCohort(policy, g, math.Max(rate-attrib, 0))
+            }
+            ageCohort(base, groups, inflow)
+            ageCohort(policy, groups, inflow)
+
+            var ly float64
+            for g := range groups {
+                ly += policy[g] - base[g]
+            }
+            deathsAvoided[t] += dBase - dPolicy
+            lifeYears[t] += ly
+            annualDeaths[y] += dBase - dPolicy
+            annualLifeYears[y] += ly
         }
-        deaths = append(deaths, dd)
     }
-    return deaths
+
+    outputPath := filepath.Join(config.OutputDir, config.OutputFile)
+    fmt.Println("writing life-table results to file")
+    if err := writeOutput(inmapCells, []ioformats.Field{{Name: "DeathsAv", Values: deathsAvoided}, {Name: "LifeYears", Values: lifeYears}}, outputPath, config); err != nil {
+        return err
+    }
+    return writeLifeTableSeries(annualDeaths, annualLifeYears, lt.StartYear, strings.TrimSuffix(outputPath, filepath.Ext(outputPath))+"_annual.csv")
 }
 
-// totDeaths calculates deaths using max concentration (for proportional attribution)
-// Original implementation for backward compatibility
-func totDeaths(totpm, resultpm, population, ijhat, countryRegrid, allcausemort []float64, params gemmParams) (deaths []float64) {
-    var maxConc []float64
-    for t := range totpm {
-        var concs float64
-        concs = math.Max(resultpm[t],totpm[t])
-        maxConc = append(maxConc, concs)
-        concs = totpm[t]
-        dd := (GEMM(concs, params.θ, params.α, params.μ, params.v) - 1) * (population[t] / ijhat[t]) * countryRegrid[t] * allcausemort[t] / 100000
-        deaths = append(deaths, dd)
+// checkLifeTableAges checks that the life-table age strata are numbers in
+// ascending order, lifeTableWidth years apart except for the open-ended last
+// stratum
+func checkLifeTableAges(ages []string) error {
+    prev := math.Inf(-1)
+    for g, age := range ages {
+        a, err := strconv.ParseFloat(age, 64)
+        if err != nil {
+            return configErrorf("lifeTable.ages", "age %q is not a number", age)
+        }
+        switch {
+        case a <= prev:
+            return configErrorf("lifeTable.ages", "ages must be in ascending order: %s follows %s", age, ages[g-1])
+        case g > 0 && g < len(ages)-1 && a-prev != lifeTableWidth:
+            return configErrorf("lifeTable.ages", "strata other than the last must be %d years wide, but %s follows %s", lifeTableWidth, age, ages[g-1])
+        }
+        prev = a
     }
+    return nil
+}
+
+// lifeTableParams returns the all-cause concentration-response function for
+// each life-table age stratum
+func lifeTableParams(entries []crf.Entry, ages []string) ([]crf.Function, error) {
+    m := crf.Map(entries)
+    params := make([]crf.Function, len(ages))
+    for g, age := range ages {
+        f, ok := m[crf.Key{Cause: "all", Age: age}]
+        if !ok {
+            return nil, configErrorf("lifeTable.ages", "no all-cause concentration-response parameters for age %s", age)
+        }
+        params[g] = f
+    }
+    return params, nil
+}
+
+// lifeTableMissing reports whether cell t has a missing (NaN) baseline
+// concentration or policy concentration in any year of the trajectory
+func lifeTableMissing(totpm float64, trajectory [][]float64, t int) bool {
+    for _, pm := range trajectory {
+        if attribution.Missing(totpm, pm[t]) {
+            return true
+        }
+    }
+    return false
+}
+
+// stepCohort removes one year of deaths at the given annual mortality rate
+// from age group g and returns the number of deaths
+func stepCohort(pop []float64, g int, rate float64) float64 {
+    deaths := pop[g] * (1 - math.Exp(-rate))
+    pop[g] -= deaths
     return deaths
 }
 
-func GEMM(z, θ, α, μ, v float64) (float64) {
-    z       =       math.Max(z-2.4,0)
-    denom   :=      1.0 + math.Exp(-(z-μ)/v)
-    numer   :=      θ * math.Log((z/α)+1)
-    return math.Exp(numer/denom)
+// ageCohort moves survivors up one year, so 1/width of each closed group
+// enters the next, and adds inflow to the youngest group
+func ageCohort(pop []float64, groups []lifeTableGroup, inflow float64) {
+    for g := len(groups) - 2; g >= 0; g-- {
+        moving := pop[g] / groups[g].width
+        pop[g] -= moving
+        pop[g+1] += moving
+    }
+    pop[0] += inflow
 }
 
-func getTots(shpFile, pol string) ([]geom.Polygonal, []float64) {
-	s, err := shp.NewDecoder(shpFile)
-	check(err)
+// writeLifeTableSeries writes the annual totals of deaths avoided and
+// life-years gained across all cells
+func writeLifeTableSeries(deaths, lifeYears []float64, startYear int, filename string) error {
+    rows := [][]string{{"year", "deaths_avoided", "life_years_gained"}}
+    for y := range deaths {
+        rows = append(rows, []string{
+            strconv.Itoa(startYear + y),
+            strconv.FormatFloat(deaths[y], 'g', -1, 64),
+            strconv.FormatFloat(lifeYears[y], 'g', -1, 64),
+        })
+    }
+    return writeCSV(filename, rows)
+}
 
-	var data []float64
-	var cells []geom.Polygonal
-	for {
-		g, fields, more := s.DecodeRowFields(pol)
-		if !more {
-			break
-		}
-        mm := strings.Replace(fields[pol]," ","",-1)
-        v, err := strconv.ParseFloat(strings.Replace(mm,"\x00", "", -1),64)
-        check(err)
-		cells = append(cells, g.(geom.Polygonal))
-		data = append(data, v)
-	}
-	s.Close()
-	check(s.Error())
-	return cells, data
+// baselineFiles returns the age fraction, baseline mortality rate and country
+// adjustment factor shapefiles for a cause/age. The age fraction and
+// mortality rate come from the projection for the configured year and
+// scenario, if any.
+func baselineFiles(cause, age string, config Config) (demogFile, acmortFile, ijhatFile string) {
+    demogFile               = projectedPath(config, filepath.Join("inputs","age"+age+".shp"))
+    acmortFile              = projectedPath(config, filepath.Join("basemorts",cause+age+".shp"))
+    ijhatFile               = filepath.Join(config.DataDir, "ijhats", cause+"_"+age+".shp")
+    return demogFile, acmortFile, ijhatFile
 }
 
-func getShpData(shpFile, pol string) ([]geom.Polygonal, []float64) {
-	s, err := shp.NewDecoder(shpFile)
-	check(err)
+// projectedPath returns the path of a demographic input relative to dataDir.
+// When a projection year is configured, the input is read from
+// dataDir/projections/<scenario>/<year>/ instead, which mirrors the layout of
+// dataDir (e.g. projections/SSP2/2050/inputs/age25.shp).
+func projectedPath(config Config, rel string) string {
+    if config.Year == 0 {
+        return filepath.Join(config.DataDir, rel)
+    }
+    return filepath.Join(config.DataDir, "projections", config.Scenario, strconv.Itoa(config.Year), rel)
+}
 
-	var data []float64
-	var cells []geom.Polygonal
-	for {
-		g, fields, more := s.DecodeRowFields(pol)
-		if !more {
-			break
-		}
-		v, err := strconv.ParseFloat(fields[pol], 64)
-		check(err)
-		cells = append(cells, g.(geom.Polygonal))
-		data = append(data, v)
+// getCellData reads a field from a shapefile of cell data. If the shapefile
+// is not on the InMAP grid (it is in another coordinate reference system, has
+// a different number of cells, or its cells are in different places or a
+// different order), it is an error with gridMismatch "error". Otherwise the
+// data are reprojected if need be and regridded onto the InMAP cells: totals
+// such as population are regridded by area-weighted sum, and rates and
+// fractions by area-weighted mean.
+func (s *baselineStore) getCellData(shpFile, field string, total bool) ([]float64, error) {
+    cells, data, err := ioformats.ReadShapefile(shpFile, field)
+    if err != nil {
+        return nil, err
+    }
+    fileCRS, err := ioformats.ShapefileCRS(shpFile)
+    if err != nil {
+        return nil, err
+    }
+    if fileCRS != nil && s.gridCRS != nil && !fileCRS.Equal(s.gridCRS) && s.config.GridMismatch == "error" {
+        return nil, &ioformats.FileError{File: shpFile, Err: fmt.Errorf("in %s rather than %s, the CRS of totalPMFile", fileCRS, s.gridCRS)}
+    }
+    if cells, err = reproject(cells, fileCRS, s.gridCRS, shpFile); err != nil {
+        return nil, err
+    }
+    mismatch := regrid.Compare(cells, s.inmapCells)
+    if mismatch == nil {
+        return data, nil
+    }
+    if s.config.GridMismatch == "error" {
+        return nil, &ioformats.FileError{File: shpFile, Err: fmt.Errorf("not on the grid of totalPMFile: %v", mismatch)}
+    }
+    fmt.Printf("Regridding %s onto the InMAP grid: %v\n", shpFile, mismatch)
+    var regridded []float64
+    if total {
+        regridded, err = s.weights(cells).Sum(data)
+    } else {
+        regridded, err = s.weights(cells).Mean(data)
+    }
+    if err != nil {
+        return nil, fmt.Errorf("regridding %s: %w", shpFile, err)
+    }
+    return regridded, nil
+}
 
-	}
-	s.Close()
-	check(s.Error())
-	return cells, data
+// readGridCRS reads the coordinate reference system of the InMAP grid from
+// the .prj file of totalPMFile. It is nil if there is none, in which case
+// every input is taken to be in the same CRS as the grid.
+func readGridCRS(config Config) (*crs.CRS, error) {
+    gridCRS, err := ioformats.ShapefileCRS(filepath.Join(config.DataDir, config.TotalPMFile))
+    if err != nil {
+        return nil, err
+    }
+    if config.AreaWeighting == "spherical" && gridCRS != nil && !gridCRS.Geographic() {
+        return nil, configErrorf("areaWeighting", "areaWeighting 'spherical' is for longitude/latitude grids, but totalPMFile is in %s; use 'planar', which measures its cells on the ground", gridCRS)
+    }
+    return gridCRS, nil
 }
 
-func regridMean(oldGeom, newGeom []geom.Polygonal, oldData []float64) (newData []float64, err error) {
-    type data struct {
-        geom.Polygonal
-        data float64
+// reproject converts the cells of file from the CRS from to the CRS to. They
+// are returned as they are if either CRS is unknown (nil) or the two are the
+// same.
+func reproject(cells []geom.Polygonal, from, to *crs.CRS, file string) ([]geom.Polygonal, error) {
+    if from == nil && to != nil {
+        fmt.Printf("%s has no coordinate reference system (.prj file); taking it to be in %s\n", file, to)
     }
-    if len(oldGeom) != len(oldData) {
-        return nil, fmt.Errorf("oldGeom and oldData have different lengths: %d!=%d", len(oldGeom), len(oldData))
+    if from == nil || to == nil || from.Equal(to) {
+        return cells, nil
     }
-    index := rtree.NewTree(25, 50)
-    for i, g := range oldGeom {
-        index.Insert(&data{
-            Polygonal: g,
-            data:      oldData[i],
-        })
+    fmt.Printf("Reprojecting %s from %s to %s\n", file, from, to)
+    projected, err := crs.Reproject(cells, from, to)
+    if err != nil {
+        return nil, &ioformats.FileError{File: file, Err: err}
     }
-    newData = make([]float64, len(newGeom))
-    for i, g := range newGeom {
-        for _, dI := range index.SearchIntersect(g.Bounds()) {
-            d := dI.(*data)
-            isect := g.Intersection(d.Polygonal)
-            if isect == nil {
-                continue
-            }
-            a := isect.Area()
-            frac := a / g.Area()
-            newData[i] += d.data * frac
+    return projected, nil
+}
+
+// mcInput holds the baseline inputs and concentration-response draws for one
+// cause/age in a Monte Carlo run
+type mcInput struct {
+    params        crf.Function
+    draws         []crf.Function
+    countryRegrid []float64
+    allcausemort  []float64
+    ijhat         []float64
+}
+
+// mcStats summarises the Monte Carlo distribution of attributable deaths per cell
+type mcStats struct {
+    point  []float64 // Deaths using the central parameter values
+    mean   []float64
+    median []float64
+    lower  []float64 // 2.5th percentile
+    upper  []float64 // 97.5th percentile
+}
+
+// getDeathsMC propagates uncertainty in the concentration-response parameters
+// (e.g. θ from the GEMM standard errors), the counterfactual concentration
+// and, optionally, in baseline mortality and population through the attribution
+// calculation. Deaths are summed over keys within each iteration before the
+// per-cell statistics are taken. Mortality and population perturbations are
+// applied as one scale factor per iteration, i.e. fully correlated across cells.
+func getDeathsMC(keys []crf.Key, baselines *baselineStore, resultpm, totpm, population []float64, g []crf.Entry, config Config) (mcStats, error) {
+    n := config.Uncertainty.Iterations
+
+    // Draw everything up front in a fixed order so results depend only on the seed
+    rng := rand.New(rand.NewSource(config.Uncertainty.Seed))
+    mortScale := make([]float64, n)
+    popScale := make([]float64, n)
+    cfs := make([]float64, n)
+    for i := 0; i < n; i++ {
+        mortScale[i] = math.Max(1+config.Uncertainty.MortalityRelSE*rng.NormFloat64(), 0)
+        popScale[i] = math.Max(1+config.Uncertainty.PopulationRelSE*rng.NormFloat64(), 0)
+        cfs[i] = config.Counterfactual.point()
+        if config.Counterfactual.Max > config.Counterfactual.Min {
+            // One counterfactual per iteration, shared by every cause/age
+            cfs[i] = config.Counterfactual.sample(rng)
         }
     }
-    return newData, nil
+    inputs := make([]mcInput, len(keys))
+    for k, key := range keys {
+        params, err := crf.Lookup(g, key.Cause, key.Age)
+        if err != nil {
+            return mcStats{}, err
+        }
+        inputs[k].params = params
+        inputs[k].draws = make([]crf.Function, n)
+        for i := range inputs[k].draws {
+            inputs[k].draws[i] = inputs[k].params.Sample(rng).WithCounterfactual(cfs[i])
+        }
+    }
+    for k, key := range keys {
+        fmt.Printf("  Loading baseline inputs: %s_%s\n", key.Cause, key.Age)
+        var err error
+        inputs[k].countryRegrid, inputs[k].allcausemort, inputs[k].ijhat, err = baselines.get(key.Cause, key.Age)
+        if err != nil {
+            return mcStats{}, err
+        }
+    }
+
+    nCells := len(totpm)
+    stats := mcStats{
+        point:  make([]float64, nCells),
+        mean:   make([]float64, nCells),
+        median: make([]float64, nCells),
+        lower:  make([]float64, nCells),
+        upper:  make([]float64, nCells),
+    }
+
+    fmt.Printf("Running %d Monte Carlo iterations over %d cells\n", n, nCells)
+    var wg sync.WaitGroup
+    nWorkers := runtime.NumCPU()
+    for w := 0; w < nWorkers; w++ {
+        wg.Add(1)
+        go func(w int) {
+            defer wg.Done()
+            samples := make([]float64, n)
+            for t := w; t < nCells; t += nWorkers {
+                if attribution.Missing(totpm[t], resultpm[t]) {
+                    stats.point[t], stats.mean[t], stats.median[t] = math.NaN(), math.NaN(), math.NaN()
+                    stats.lower[t], stats.upper[t] = math.NaN(), math.NaN()
+                    continue
+                }
+                for i := range samples {
+                    samples[i] = 0
+                }
+                var point, sum float64
+                for _, in := range inputs {
+                    point += attribution.Cell(config.AttributionMethod, totpm[t], resultpm[t], population[t],
+                        in.ijhat[t], in.countryRegrid[t], in.allcausemort[t], in.params)
+                    for i := range samples {
+                        samples[i] += attribution.Cell(config.AttributionMethod, totpm[t], resultpm[t], population[t]*popScale[i],
+                            in.ijhat[t], in.countryRegrid[t], in.allcausemort[t]*mortScale[i], in.draws[i])
+                    }
+                }
+                for _, v := range samples {
+                    sum += v
+                }
+                sort.Float64s(samples)
+                stats.point[t] = point
+                stats.mean[t] = sum / float64(n)
+                stats.median[t] = percentile(samples, 50)
+                stats.lower[t] = percentile(samples, 2.5)
+                stats.upper[t] = percentile(samples, 97.5)
+            }
+        }(w)
+    }
+    wg.Wait()
+    return stats, nil
 }
 
-// Handle errors
-func check(err error) {
+// percentile returns the pth percentile of sorted data, interpolating linearly
+// between the closest ranks
+func percentile(sorted []float64, p float64) float64 {
+    if len(sorted) == 1 {
+        return sorted[0]
+    }
+    rank := p / 100 * float64(len(sorted)-1)
+    lo := int(math.Floor(rank))
+    hi := int(math.Ceil(rank))
+    frac := rank - float64(lo)
+    return sorted[lo] + frac*(sorted[hi]-sorted[lo])
+}
+
+// uncertaintyFields lists the point estimate and Monte Carlo summary statistics
+// of attributable deaths as output fields
+func uncertaintyFields(stats mcStats) []ioformats.Field {
+	return []ioformats.Field{
+		{Name: "TotalPopD", Values: stats.point},
+		{Name: "Mean", Values: stats.mean},
+		{Name: "Median", Values: stats.median},
+		{Name: "Lower95", Values: stats.lower},
+		{Name: "Upper95", Values: stats.upper},
+	}
+}
+
+// writeOutput writes the output fields in the configured format. NetCDF
+// outputs replace the extension of filename with .nc. Shapefiles are written
+// in the CRS of the InMAP grid, with a copy of its .prj file, and NetCDF and
+// GeoPackage outputs in longitude/latitude.
+func writeOutput(cells []geom.Polygonal, fields []ioformats.Field, filename string, config Config) error {
+	gridCRS, err := ioformats.ShapefileCRS(filepath.Join(config.DataDir, config.TotalPMFile))
 	if err != nil {
-		panic(err)
+		return err
+	}
+	switch config.OutputFormat {
+	case "netcdf", "gpkg":
+		// Both are written in longitude/latitude
+		if cells, err = reproject(cells, gridCRS, crs.WGS84, "the InMAP grid"); err != nil {
+			return err
+		}
+		if config.OutputFormat == "netcdf" {
+			return writeNetCDF(cells, fields, strings.TrimSuffix(filename, filepath.Ext(filename))+".nc", config)
+		}
+		return writeGeoPackage(cells, fields, strings.TrimSuffix(filename, filepath.Ext(filename))+".gpkg", config)
+	default:
+		if len(fields) == 1 && fields[0].Name == "TotalPopD" {
+			err = ioformats.WriteTotDeaths(cells, fields[0].Values, filename)
+		} else {
+			err = ioformats.WriteShapefile(cells, fields, filename)
+		}
+		if err != nil {
+			return err
+		}
+		// The outputs are on the InMAP grid, in its CRS
+		return ioformats.WritePrj(filename, gridCRS)
 	}
 }
 
-func writeTotDeaths(cells []geom.Polygonal, inputData []float64, filename string) {
-	type shpOut struct {
-		geom.Polygon
-		TotalPopD float64
+// writeNetCDF writes the output fields to a CF-compliant NetCDF file, with one
+// variable per field. On the "inmap" grid, the cells are written as an
+// unstructured mesh along a cell dimension. On the "input" grid, the results
+// are regridded by area-weighted sum onto the lat/lon grid of the NetCDF
+// resultFile, so totals are conserved.
+func writeNetCDF(cells []geom.Polygonal, fields []ioformats.Field, filename string, config Config) error {
+	opts := ioformats.NetCDFOptions{
+		Attributes: fieldAttributes,
+		Global:     provenance(config),
+	}
+	if config.NCOutputGrid == "input" {
+		grid, err := ioformats.ReadLatLonGrid(config.ResultFile, config.NCVarName)
+		if err != nil {
+			return err
+		}
+		opts.Grid = grid
+		opts.Area, _ = regrid.AreaMethod(config.AreaWeighting)
+		fmt.Println("Regridding results onto the input grid...")
 	}
+	return ioformats.WriteNetCDF(cells, fields, filename, opts)
+}
 
-	e, err := shp.NewEncoder(filename, shpOut{})
-	check(err)
-	for i, c := range cells {
-		check(e.Encode(shpOut{
-			Polygon:        c.Polygons()[0], // Assuming we are not using a multipolygon.
-			TotalPopD:      inputData[i],
-		}))
+// writeGeoPackage writes a GeoPackage with three tables: "cells", a feature
+// table of the InMAP cells with one column per output field; "countries", a
+// feature table of the fields summed to each country, if countryMapping is
+// configured; and "run_metadata", an attribute table of the provenance of the
+// run as key/value pairs. An existing file is replaced. The cells must be in
+// longitude/latitude, and the countries are reprojected to it.
+func writeGeoPackage(cells []geom.Polygonal, fields []ioformats.Field, filename string, config Config) error {
+	tables := []ioformats.FeatureTable{{
+		Name:        "cells",
+		Description: "Results per InMAP cell",
+		Shapes:      cells,
+		Fields:      fields,
+	}}
+
+	if config.CountryMapping.MappingFile != "" {
+		fmt.Println("Summing results by country...")
+		shapes, names, _, err := ioformats.ReadGeoPackageFeatures(config.CountryMapping.CountryFile, countryNameColumn)
+		if err != nil {
+			return err
+		}
+		countryCRS, err := ioformats.GeoPackageCRS(config.CountryMapping.CountryFile)
+		if err != nil {
+			return err
+		}
+		if shapes, err = reproject(shapes, countryCRS, crs.WGS84, config.CountryMapping.CountryFile); err != nil {
+			return err
+		}
+		mapping, err := aggregate.LoadMapping(config.CountryMapping.MappingFile)
+		if err != nil {
+			return err
+		}
+		if err := aggregate.Check(mapping, len(cells), len(shapes)); err != nil {
+			return &ioformats.FileError{File: config.CountryMapping.MappingFile,
+				Err: fmt.Errorf("does not match the InMAP grid and %s: %v", config.CountryMapping.CountryFile, err)}
+		}
+		countryFields := make([]ioformats.Field, len(fields))
+		for j, f := range fields {
+			countryFields[j] = ioformats.Field{Name: f.Name, Values: aggregate.Apply(mapping, f.Values, len(shapes))}
+		}
+		tables = append(tables, ioformats.FeatureTable{
+			Name:        "countries",
+			Description: "Results summed by country",
+			Shapes:      shapes,
+			Names:       names,
+			Fields:      countryFields,
+		})
 	}
-	e.Close()
-}
-
-// zeroOut calculates attribution using absolute difference methodology
-// Formula: deaths = totalDeaths - baselineDeaths
-// Represents deaths that would be avoided if source were removed entirely
-func zeroOut(totdeaths, baseline []float64) ([]float64) {
-    var attrib []float64
-    for t := range totdeaths {
-        var dd float64
-        if totdeaths[t] == 0.0 {
-            dd = 0.0
-        } else {
-            dd = totdeaths[t] - baseline[t]
-            if math.IsNaN(dd) {
-                dd = 0.0
-            }
-        }
-        attrib = append(attrib, dd)
-    }
-    return attrib
+
+	return ioformats.WriteGeoPackage(filename, tables, provenance(config))
 }
 
-// attribution calculates proportional attribution
-// Formula: deaths = resultpm * totdeaths / totpm
-// Represents proportional contribution of source to total deaths
-func attribution(totpm, totdeaths, resultpm []float64) ([]float64) {
-    var attrib []float64
-    for t := range totpm {
-        var dd float64
-        if totpm[t] == 0.0 {
-            dd = 0.0
-        } else {
-            dd = resultpm[t] * totdeaths[t] / totpm[t]
-            if math.IsNaN(dd) {
-                dd = 0.0
-            }
-        }
-        attrib = append(attrib, dd)
-    }
-    return attrib
+// fieldAttributes returns the CF long_name and units of an output field.
+// Deaths are counts, which CF expresses with units of 1.
+func fieldAttributes(name string) (longName, units string) {
+	switch name {
+	case "TotalPopD":
+		return "Deaths attributable to PM2.5", "1"
+	case "YLL":
+		return "Years of life lost to PM2.5", "year"
+	case "YLD":
+		return "Years lived with disability due to PM2.5", "year"
+	case "DALY":
+		return "Disability-adjusted life years due to PM2.5", "year"
+	case "Damages":
+		return "Monetary damages of attributable deaths, in the currency of valuation.vsl", "1"
+	case "Mean":
+		return "Mean deaths attributable to PM2.5 over Monte Carlo iterations", "1"
+	case "Median":
+		return "Median deaths attributable to PM2.5 over Monte Carlo iterations", "1"
+	case "Lower95":
+		return "2.5th percentile of deaths attributable to PM2.5 over Monte Carlo iterations", "1"
+	case "Upper95":
+		return "97.5th percentile of deaths attributable to PM2.5 over Monte Carlo iterations", "1"
+	case "DeathsAv":
+		return "Cumulative deaths avoided", "1"
+	case "LifeYears":
+		return "Cumulative life-years gained", "year"
+	case otherSource:
+		return "Deaths attributable to PM2.5 not from the listed sources", "1"
+	default:
+		// Sources and combined cause/age fields
+		return "Deaths attributable to PM2.5: " + name, "1"
+	}
+}
+
+// provenance lists the global attributes describing how an output was made
+func provenance(config Config) [][2]string {
+	attrs := [][2]string{
+		{"Conventions", "CF-1.8"},
+		{"title", "Mortality attributable to PM2.5"},
+		{"source", "aqhealth"},
+		{"history", time.Now().UTC().Format(time.RFC3339) + ": " + strings.Join(os.Args, " ")},
+		{"output_mode", config.OutputSpec.Mode},
+		{"attribution_method", config.AttributionMethod},
+		{"concentration_response_function", config.CRF},
+		{"counterfactual_concentration", fmt.Sprintf("%g-%g ug/m3", config.Counterfactual.Min, config.Counterfactual.Max)},
+		{"total_pm_file", filepath.Join(config.DataDir, config.TotalPMFile)},
+		{"population_file", projectedPath(config, config.PopFile)},
+		{"area_weighting", config.AreaWeighting},
+	}
+	if len(config.Sources) > 0 {
+		var files []string
+		for _, src := range config.Sources {
+			files = append(files, src.Name+"="+src.File)
+		}
+		attrs = append(attrs, [2]string{"source_files", strings.Join(files, ", ")})
+	} else {
+		attrs = append(attrs, [2]string{"result_file", config.ResultFile})
+	}
+	if config.Year != 0 {
+		attrs = append(attrs, [2]string{"projection", fmt.Sprintf("%s %d", config.Scenario, config.Year)})
+	}
+	return attrs
 }
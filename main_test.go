@@ -0,0 +1,76 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestStepCohort(t *testing.T) {
+	pop := []float64{1000, 500}
+	deaths := stepCohort(pop, 1, 0.02)
+	want := 500 * (1 - math.Exp(-0.02))
+	if math.Abs(deaths-want) > 1e-9 {
+		t.Errorf("deaths = %g, want %g", deaths, want)
+	}
+	if math.Abs(pop[1]-(500-want)) > 1e-9 || pop[0] != 1000 {
+		t.Errorf("population after one year = %v", pop)
+	}
+}
+
+func TestAgeCohort(t *testing.T) {
+	groups := []lifeTableGroup{{width: 5}, {width: 5}, {width: 0}}
+	pop := []float64{100, 50, 200}
+	ageCohort(pop, groups, 20)
+	// A fifth of each closed stratum moves up: 20 from the first, 10 from
+	// the second; the first then receives the inflow of 20
+	want := []float64{100, 60, 210}
+	for g := range want {
+		if math.Abs(pop[g]-want[g]) > 1e-9 {
+			t.Fatalf("population after ageing = %v, want %v", pop, want)
+		}
+	}
+}
+
+func TestAgeCohortSteadyState(t *testing.T) {
+	// Without deaths, an inflow of the youngest stratum's size over its
+	// width keeps it constant, fills every closed stratum to the same size,
+	// and adds the inflow to the total each year
+	groups := []lifeTableGroup{{width: 5}, {width: 5}, {width: 5}, {width: 0}}
+	pop := []float64{100, 0, 0, 0}
+	inflow := pop[0] / groups[0].width
+	for y := 0; y < 200; y++ {
+		before := pop[0] + pop[1] + pop[2] + pop[3]
+		ageCohort(pop, groups, inflow)
+		after := pop[0] + pop[1] + pop[2] + pop[3]
+		if math.Abs(after-before-inflow) > 1e-9 {
+			t.Fatalf("year %d: total grew by %g, want %g", y, after-before, inflow)
+		}
+		if math.Abs(pop[0]-100) > 1e-9 {
+			t.Fatalf("year %d: youngest stratum is %g, want 100", y, pop[0])
+		}
+	}
+	for g := 1; g < 3; g++ {
+		if math.Abs(pop[g]-100) > 1e-6 {
+			t.Errorf("stratum %d = %g after 200 years, want 100", g, pop[g])
+		}
+	}
+}
+
+func TestCheckLifeTableAges(t *testing.T) {
+	for _, tc := range []struct {
+		ages []string
+		ok   bool
+	}{
+		{[]string{"25"}, true},
+		{[]string{"27.5", "32.5", "37.5", "42.5", "47.5", "52.5", "57.5", "62.5", "67.5", "72.5", "77.5", "85"}, true},
+		{[]string{"25", "30", "80"}, true}, // The open-ended last stratum may start anywhere above
+		{[]string{"25", "35", "40"}, false},
+		{[]string{"30", "25"}, false},
+		{[]string{"25", "thirty"}, false},
+	} {
+		err := checkLifeTableAges(tc.ages)
+		if (err == nil) != tc.ok {
+			t.Errorf("checkLifeTableAges(%v) = %v, want ok=%v", tc.ages, err, tc.ok)
+		}
+	}
+}
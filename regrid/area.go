@@ -0,0 +1,55 @@
+package regrid
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/ctessum/geom"
+)
+
+// AreaFunc returns the area of a cell or of the intersection of two cells.
+// Regridding weights are ratios of areas, so its units do not matter.
+type AreaFunc func(geom.Polygonal) float64
+
+// EarthRadius is the mean radius of the Earth in km, used by Spherical
+const EarthRadius = 6371.0088
+
+// Planar returns the area of a cell in the units of its coordinates. For
+// longitude/latitude grids this is in square degrees, which overweights
+// cells the further they are from the equator.
+func Planar(g geom.Polygonal) float64 {
+	return g.Area()
+}
+
+// Spherical returns the area in km² on the sphere of a cell whose
+// coordinates are longitudes and latitudes in degrees. The cell is projected
+// onto the Lambert cylindrical equal-area projection, so the area is exact
+// for cells bounded by meridians and parallels and close for others. Holes
+// are subtracted as Planar does.
+func Spherical(g geom.Polygonal) float64 {
+	const deg = math.Pi / 180
+	var a float64
+	for _, p := range g.Polygons() {
+		q := make(geom.Polygon, len(p))
+		for i, ring := range p {
+			q[i] = make([]geom.Point, len(ring))
+			for j, pt := range ring {
+				lat := math.Max(-90, math.Min(90, pt.Y))
+				q[i][j] = geom.Point{X: EarthRadius * pt.X * deg, Y: EarthRadius * math.Sin(lat*deg)}
+			}
+		}
+		a += q.Area()
+	}
+	return math.Abs(a)
+}
+
+// AreaMethod returns the AreaFunc named "planar" or "spherical"
+func AreaMethod(name string) (AreaFunc, error) {
+	switch name {
+	case "planar", "":
+		return Planar, nil
+	case "spherical":
+		return Spherical, nil
+	}
+	return nil, fmt.Errorf("area weighting must be 'planar' or 'spherical', not %q", name)
+}
@@ -0,0 +1,58 @@
+// Package regrid transfers gridded data between polygon grids by area
+// weighting.
+package regrid
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/ctessum/geom"
+)
+
+// Mean regrids concentrations or rates by area-weighted mean: each new cell
+// gets the mean of the old cells it overlaps, weighted by the overlap as a
+// fraction of the new cell. Parts of a new cell not covered by the old grid
+// count as zero, but new cells the old grid does not reach at all are NaN.
+// Old cells that are NaN are missing: the new cell gets the mean of the rest
+// of the old cells it overlaps, or NaN if it only overlaps missing cells. Areas are planar; to weight by area on the sphere, or to
+// regrid several fields between the same grids, compute the Weights once
+// instead.
+func Mean(oldGeom, newGeom []geom.Polygonal, oldData []float64) (newData []float64, err error) {
+	if len(oldGeom) != len(oldData) {
+		return nil, fmt.Errorf("oldGeom and oldData have different lengths: %d!=%d", len(oldGeom), len(oldData))
+	}
+	return ComputeWeights(oldGeom, newGeom, Planar).Mean(oldData)
+}
+
+// Sum regrids totals (e.g. population or deaths) by area-weighted sum, so
+// that the total is conserved where the new grid covers the old one. Old
+// cells that are NaN are missing and add nothing to the new cells. New
+// cells are processed in parallel, which matters when aggregating to a few
+// large countries. Areas are planar, as for Mean.
+func Sum(oldGeom, newGeom []geom.Polygonal, oldData []float64) (newData []float64, err error) {
+	if len(oldGeom) != len(oldData) {
+		return nil, fmt.Errorf("oldGeom and oldData have different lengths: %d!=%d", len(oldGeom), len(oldData))
+	}
+	return ComputeWeights(oldGeom, newGeom, Planar).Sum(oldData)
+}
+
+// Compare returns an error describing the first difference between two
+// grids, or nil if they have the same number of cells and the bounds of each
+// cell agree to within a millionth of its size. Data on grids that match can
+// be combined cell by cell without regridding; grids with the same cells in
+// a different order do not match.
+func Compare(g, ref []geom.Polygonal) error {
+	if len(g) != len(ref) {
+		return fmt.Errorf("%d cells instead of %d", len(g), len(ref))
+	}
+	for i := range g {
+		b, r := g[i].Bounds(), ref[i].Bounds()
+		tol := 1e-6 * (r.Max.X - r.Min.X + r.Max.Y - r.Min.Y)
+		if math.Abs(b.Min.X-r.Min.X) > tol || math.Abs(b.Min.Y-r.Min.Y) > tol ||
+			math.Abs(b.Max.X-r.Max.X) > tol || math.Abs(b.Max.Y-r.Max.Y) > tol {
+			return fmt.Errorf("cell %d spans (%g, %g)-(%g, %g) instead of (%g, %g)-(%g, %g)", i,
+				b.Min.X, b.Min.Y, b.Max.X, b.Max.Y, r.Min.X, r.Min.Y, r.Max.X, r.Max.Y)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,228 @@
+package regrid
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"runtime"
+	"sync"
+
+	"github.com/ctessum/geom"
+	"github.com/ctessum/geom/index/rtree"
+)
+
+// Weight is one entry in the sparse intersection matrix between an old and
+// a new grid
+type Weight struct {
+	Old, New int     // Cell indices
+	OfNew    float64 // Intersection as a fraction of the area of the new cell
+	OfOld    float64 // Intersection as a fraction of the area of the old cell
+}
+
+// Weights is the sparse intersection matrix between two grids. It can be
+// computed once, saved, and applied to any data on the old grid, by
+// area-weighted mean or sum.
+type Weights struct {
+	NOld, NNew int
+	Records    []Weight // In order of New
+}
+
+// ComputeWeights intersects every new cell with the old cells it overlaps,
+// measuring the cells and their intersections with area (Planar if nil).
+// New cells are processed in parallel.
+func ComputeWeights(oldGeom, newGeom []geom.Polygonal, area AreaFunc) *Weights {
+	if area == nil {
+		area = Planar
+	}
+	type data struct {
+		geom.Polygonal
+		index int
+		area  float64 // Cache the area
+	}
+	index := rtree.NewTree(25, 50)
+	for i, g := range oldGeom {
+		index.Insert(&data{
+			Polygonal: g,
+			index:     i,
+			area:      area(g),
+		})
+	}
+	perCell := make([][]Weight, len(newGeom))
+	nWorkers := runtime.NumCPU()
+	var wg sync.WaitGroup
+	for w := 0; w < nWorkers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < len(newGeom); i += nWorkers {
+				g := newGeom[i]
+				a := area(g)
+				for _, dI := range index.SearchIntersect(g.Bounds()) {
+					d := dI.(*data)
+					isect := g.Intersection(d.Polygonal)
+					if isect == nil {
+						continue
+					}
+					ai := area(isect)
+					perCell[i] = append(perCell[i], Weight{Old: d.index, New: i, OfNew: ai / a, OfOld: ai / d.area})
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	w := &Weights{NOld: len(oldGeom), NNew: len(newGeom)}
+	for _, r := range perCell {
+		w.Records = append(w.Records, r...)
+	}
+	return w
+}
+
+// Mean regrids concentrations or rates by area-weighted mean, as the Mean
+// function does
+func (w *Weights) Mean(oldData []float64) ([]float64, error) {
+	if len(oldData) != w.NOld {
+		return nil, fmt.Errorf("weights are for %d cells, but the data has %d", w.NOld, len(oldData))
+	}
+	newData := make([]float64, w.NNew)
+	covered := make([]float64, w.NNew) // Fraction of each new cell in old cells
+	valid := make([]float64, w.NNew)   // and in old cells with data
+	for _, r := range w.Records {
+		covered[r.New] += r.OfNew
+		if math.IsNaN(oldData[r.Old]) {
+			continue
+		}
+		valid[r.New] += r.OfNew
+		newData[r.New] += oldData[r.Old] * r.OfNew
+	}
+	for i := range newData {
+		switch {
+		case valid[i] == 0:
+			// Outside the old grid, or only over missing cells
+			newData[i] = math.NaN()
+		case valid[i] < covered[i]:
+			// Spread the cells with data over the missing ones
+			newData[i] *= covered[i] / valid[i]
+		}
+	}
+	return newData, nil
+}
+
+// Sum regrids totals by area-weighted sum, as the Sum function does
+func (w *Weights) Sum(oldData []float64) ([]float64, error) {
+	if len(oldData) != w.NOld {
+		return nil, fmt.Errorf("weights are for %d cells, but the data has %d", w.NOld, len(oldData))
+	}
+	newData := make([]float64, w.NNew)
+	for _, r := range w.Records {
+		if math.IsNaN(oldData[r.Old]) {
+			continue
+		}
+		newData[r.New] += oldData[r.Old] * r.OfOld
+	}
+	return newData, nil
+}
+
+// weightsMagic and weightsVersion start every weights file
+var weightsMagic = []byte("AQHW")
+
+const weightsVersion = 1
+
+// Save writes the weights to a binary file
+func (w *Weights) Save(filename string) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	b := bufio.NewWriter(f)
+	b.Write(weightsMagic)
+	for _, v := range []uint64{weightsVersion, uint64(w.NOld), uint64(w.NNew), uint64(len(w.Records))} {
+		binary.Write(b, binary.LittleEndian, v)
+	}
+	var rec [24]byte
+	for _, r := range w.Records {
+		binary.LittleEndian.PutUint32(rec[0:], uint32(r.Old))
+		binary.LittleEndian.PutUint32(rec[4:], uint32(r.New))
+		binary.LittleEndian.PutUint64(rec[8:], math.Float64bits(r.OfNew))
+		binary.LittleEndian.PutUint64(rec[16:], math.Float64bits(r.OfOld))
+		b.Write(rec[:])
+	}
+	if err := b.Flush(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// LoadWeights reads weights written by Save
+func LoadWeights(filename string) (*Weights, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	b := bufio.NewReader(f)
+	magic := make([]byte, len(weightsMagic))
+	if _, err := io.ReadFull(b, magic); err != nil || string(magic) != string(weightsMagic) {
+		return nil, errors.New("not a regridding weights file")
+	}
+	var header [4]uint64
+	if err := binary.Read(b, binary.LittleEndian, &header); err != nil {
+		return nil, err
+	}
+	if header[0] != weightsVersion {
+		return nil, fmt.Errorf("weights file version %d instead of %d", header[0], weightsVersion)
+	}
+	w := &Weights{NOld: int(header[1]), NNew: int(header[2])}
+	w.Records = make([]Weight, header[3])
+	var rec [24]byte
+	for i := range w.Records {
+		if _, err := io.ReadFull(b, rec[:]); err != nil {
+			return nil, err
+		}
+		r := Weight{
+			Old:   int(binary.LittleEndian.Uint32(rec[0:])),
+			New:   int(binary.LittleEndian.Uint32(rec[4:])),
+			OfNew: math.Float64frombits(binary.LittleEndian.Uint64(rec[8:])),
+			OfOld: math.Float64frombits(binary.LittleEndian.Uint64(rec[16:])),
+		}
+		if r.Old >= w.NOld || r.New >= w.NNew {
+			return nil, fmt.Errorf("record %d refers to cells %d and %d of %d and %d", i, r.Old, r.New, w.NOld, w.NNew)
+		}
+		w.Records[i] = r
+	}
+	return w, nil
+}
+
+// Hash returns a hash of the coordinates of every cell of a grid, in order,
+// which identifies the grid whatever file it was read from
+func Hash(cells []geom.Polygonal) string {
+	h := sha256.New()
+	var b [8]byte
+	put := func(v uint64) {
+		binary.LittleEndian.PutUint64(b[:], v)
+		h.Write(b[:])
+	}
+	put(uint64(len(cells)))
+	for _, c := range cells {
+		polys := c.Polygons()
+		put(uint64(len(polys)))
+		for _, p := range polys {
+			put(uint64(len(p)))
+			for _, ring := range p {
+				put(uint64(len(ring)))
+				for _, pt := range ring {
+					put(math.Float64bits(pt.X))
+					put(math.Float64bits(pt.Y))
+				}
+			}
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
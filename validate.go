@@ -0,0 +1,249 @@
+package main
+
+// The -validate (or -dry-run) flag checks that a run's inputs exist and fit
+// together without calculating anything, so a missing file is found before
+// the regridding rather than after it.
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ctessum/geom"
+
+	"mortality/crf"
+	"mortality/crs"
+	"mortality/ioformats"
+	"mortality/regrid"
+)
+
+// inputCheck collects the problems found by validateInputs
+type inputCheck struct {
+	grid     []geom.Polygonal // Cells of totalPMFile; nil if it could not be read
+	gridCRS  *crs.CRS         // CRS of totalPMFile; nil if unknown
+	strict   bool             // Inputs on other grids are problems rather than regridded
+	checked  map[string]bool
+	problems []error
+}
+
+// fail records a problem
+func (c *inputCheck) fail(err error) {
+	fmt.Printf("  ERROR %v\n", err)
+	c.problems = append(c.problems, err)
+}
+
+// exists checks that file exists, returning false if it doesn't or if it has
+// already been checked
+func (c *inputCheck) exists(file string) bool {
+	if c.checked[file] {
+		return false
+	}
+	c.checked[file] = true
+	if _, err := os.Stat(file); os.IsNotExist(err) {
+		c.fail(&ioformats.FileError{File: file, Err: errors.New("file not found")})
+		return false
+	} else if err != nil {
+		c.fail(err)
+		return false
+	}
+	return true
+}
+
+// checkCRS checks that the coordinate reference system of a file, if it has
+// one, is supported
+func (c *inputCheck) checkCRS(file string) {
+	fileCRS, err := ioformats.ReadCRS(file)
+	if err != nil {
+		c.fail(err)
+	} else if fileCRS != nil && c.gridCRS != nil && !fileCRS.Equal(c.gridCRS) {
+		fmt.Printf("  %s will be reprojected from %s\n", file, fileCRS)
+	}
+}
+
+// cells checks that a shapefile of cell data exists and has the same cells
+// as totalPMFile in the same order and the same CRS, as getCellData does. The
+// geometries are only read if the number of rows matches.
+func (c *inputCheck) cells(file string) {
+	if !c.exists(file) || c.grid == nil {
+		return
+	}
+	fileCRS, err := ioformats.ShapefileCRS(file)
+	if err != nil {
+		c.fail(err)
+		return
+	}
+	if fileCRS != nil && c.gridCRS != nil && !fileCRS.Equal(c.gridCRS) {
+		if c.strict {
+			c.fail(&ioformats.FileError{File: file, Err: fmt.Errorf("in %s rather than %s, the CRS of totalPMFile", fileCRS, c.gridCRS)})
+			return
+		}
+		fmt.Printf("  %s will be reprojected from %s and regridded onto the InMAP grid\n", file, fileCRS)
+		return
+	}
+	n, err := ioformats.ShapefileRows(file)
+	if err != nil {
+		c.fail(err)
+		return
+	}
+	mismatch := fmt.Errorf("%d cells instead of %d", n, len(c.grid))
+	if n == len(c.grid) {
+		cells, err := ioformats.ReadShapefileGeometries(file)
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		if mismatch = regrid.Compare(cells, c.grid); mismatch == nil {
+			return
+		}
+	}
+	if c.strict {
+		c.fail(&ioformats.FileError{File: file, Err: fmt.Errorf("not on the grid of totalPMFile: %v", mismatch)})
+		return
+	}
+	fmt.Printf("  %s will be regridded onto the InMAP grid: %v\n", file, mismatch)
+}
+
+// validateInputs checks, without calculating anything, that every file the
+// configured run would read exists, that the requested causes and ages are in
+// the concentration-response table, that the coordinate reference systems of
+// the inputs are supported, that the NetCDF concentrations can be read, and
+// that the cell inputs are on the grid of totalPMFile (with gridMismatch
+// "regrid", those that are not are listed instead). Problems are printed as
+// they are found, and the first is returned.
+func validateInputs(config Config) error {
+	fmt.Println("Validating inputs (dry run, nothing will be calculated)")
+	c := &inputCheck{strict: config.GridMismatch == "error", checked: make(map[string]bool)}
+
+	totalPMFile := filepath.Join(config.DataDir, config.TotalPMFile)
+	if c.exists(totalPMFile) {
+		grid, err := ioformats.ReadShapefileGeometries(totalPMFile)
+		if err != nil {
+			c.fail(err)
+		} else {
+			c.grid = grid
+			fmt.Printf("  %s has %d cells\n", totalPMFile, len(grid))
+		}
+		if gridCRS, err := readGridCRS(config); err != nil {
+			c.fail(err)
+		} else if gridCRS != nil {
+			c.gridCRS = gridCRS
+			fmt.Printf("  %s is in %s\n", totalPMFile, gridCRS)
+		}
+	}
+
+	// Concentrations are always regridded onto the InMAP cells. NetCDF files
+	// are read, to check that the variable, its grid and the layer and time
+	// can be found.
+	type concFile struct{ file, ncVarName string }
+	var concFiles []concFile
+	switch {
+	case config.OutputSpec.Mode == "lifetable":
+		for _, file := range config.LifeTable.Trajectory {
+			concFiles = append(concFiles, concFile{file, config.NCVarName})
+		}
+	case len(config.Sources) > 0:
+		for _, src := range config.Sources {
+			concFiles = append(concFiles, concFile{src.File, src.NCVarName})
+		}
+	default:
+		concFiles = []concFile{{config.ResultFile, config.NCVarName}}
+	}
+	if config.AttributionMethod == "scenario" && config.BaselineFile != "" {
+		concFiles = append(concFiles, concFile{config.BaselineFile, config.NCVarName})
+	}
+	for _, f := range concFiles {
+		if !c.exists(f.file) {
+			continue
+		}
+		c.checkCRS(f.file)
+		if strings.HasSuffix(strings.ToLower(f.file), ".nc") {
+			if _, _, err := ioformats.ReadNetCDF(f.file, f.ncVarName, config.NCLayer, config.NCTime); err != nil {
+				c.fail(err)
+			}
+		}
+	}
+	c.cells(projectedPath(config, config.PopFile))
+
+	entries, err := readCRF(config)
+	if err != nil {
+		c.fail(err)
+	} else {
+		for _, k := range validationKeys(config, entries, c) {
+			demogFile, acmortFile, ijhatFile := baselineFiles(k.Cause, k.Age, config)
+			c.cells(demogFile)
+			c.cells(acmortFile)
+			c.cells(ijhatFile)
+		}
+	}
+
+	if config.HealthMetrics.LifeTableFile != "" {
+		c.exists(filepath.Join(config.DataDir, config.HealthMetrics.LifeTableFile))
+	}
+	if config.HealthMetrics.YLDFile != "" {
+		c.exists(filepath.Join(config.DataDir, config.HealthMetrics.YLDFile))
+	}
+	if config.Valuation.VSL > 0 {
+		c.exists(filepath.Join(config.DataDir, config.Valuation.IncomeFile))
+	}
+	for _, m := range [][2]string{
+		{config.CountryMapping.MappingFile, config.CountryMapping.CountryFile},
+		{config.Valuation.MappingFile, config.Valuation.CountryFile},
+		{config.Exposure.MappingFile, config.Exposure.CountryFile},
+	} {
+		if m[0] == "" || c.checked[m[0]] {
+			continue
+		}
+		mappingOK, countryOK := c.exists(m[0]), c.exists(m[1])
+		if mappingOK && countryOK && c.grid != nil {
+			if _, _, err := loadCountryMapping(m[0], m[1], len(c.grid)); err != nil {
+				c.fail(err)
+			}
+		}
+	}
+
+	if len(c.problems) > 0 {
+		return fmt.Errorf("validation found %d problem(s), the first: %w", len(c.problems), c.problems[0])
+	}
+	fmt.Printf("Validation passed: %d files checked\n", len(c.checked))
+	return nil
+}
+
+// validationKeys returns the cause/age combinations the run would read
+// baseline inputs for, recording a problem for each one missing from the
+// concentration-response table
+func validationKeys(config Config, entries []crf.Entry, c *inputCheck) []crf.Key {
+	m := crf.Map(entries)
+	if config.OutputSpec.Mode == "lifetable" {
+		if _, err := lifeTableParams(entries, config.LifeTable.Ages); err != nil {
+			c.fail(err)
+		}
+		var keys []crf.Key
+		for _, age := range config.LifeTable.Ages {
+			keys = append(keys, crf.Key{Cause: "all", Age: age})
+		}
+		return keys
+	}
+
+	groups, err := outputGroups(config, entries)
+	if err != nil {
+		c.fail(err)
+		return nil
+	}
+	if config.HealthMetrics.LifeTableFile != "" {
+		if err := checkAgeResolved(groups, entries); err != nil {
+			c.fail(err)
+		}
+	}
+	var keys []crf.Key
+	for _, og := range groups {
+		for _, k := range og.keys {
+			if _, ok := m[k]; !ok {
+				c.fail(&ioformats.FileError{File: crfPath(config), Err: fmt.Errorf("no concentration-response parameters for cause=%s, age=%s", k.Cause, k.Age)})
+			}
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}